@@ -0,0 +1,365 @@
+/*
+Copyright 2016-2017 Ronmi Ren <ronmi@patrolavia.com>
+
+This file is part of YNIT.
+
+YNIT is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+YNIT is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with YNIT.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ControlRequest is sent by ynitctl through control socket, one JSON object per line
+type ControlRequest struct {
+	Command  string   `json:"command"`
+	Services []string `json:"services,omitempty"`
+	Restart  bool     `json:"restart,omitempty"` // restart changed services after daemon-reload
+	Signal   string   `json:"signal,omitempty"`  // signal to send by kill command
+}
+
+// ControlResponse is the result of a ControlRequest
+type ControlResponse struct {
+	OK      bool      `json:"ok"`
+	Error   string    `json:"error,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Report  *Report   `json:"report,omitempty"` // result of starting services
+	Status  *Snapshot `json:"status,omitempty"`
+}
+
+// Controller executes control commands one at a time, which come from control
+// socket or signals
+type Controller struct {
+	sup      *Supervisor
+	confdir  string // where to load services again
+	main     string // service named by -main option
+	restart  bool   // restart changed services after daemon-reload by default
+	listener *net.UnixListener
+	*sync.Mutex
+}
+
+// NewController creates a Controller instance
+func NewController(sup *Supervisor, confdir, main string, restart bool) *Controller {
+	return &Controller{
+		sup,
+		confdir,
+		main,
+		restart,
+		nil,
+		new(sync.Mutex),
+	}
+}
+
+// Listen creates control socket at path, which is accessible by owner and
+// group with permission mode
+func (c *Controller) Listen(path string, mode os.FileMode, group string) (err error) {
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+	_ = os.Remove(path)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return
+	}
+	if err = setPerm(path, mode, group); err != nil {
+		l.Close()
+		return
+	}
+
+	c.listener = l
+	go c.serve()
+	return
+}
+
+// setPerm changes permission and group of a file
+func setPerm(path string, mode os.FileMode, group string) error {
+	if group != "" {
+		gid, err := strconv.Atoi(group)
+		if err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return err
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+		if err = os.Chown(path, -1, gid); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(path, mode)
+}
+
+func (c *Controller) serve() {
+	for {
+		conn, err := c.listener.AcceptUnix()
+		if err != nil {
+			return
+		}
+		go c.handle(conn)
+	}
+}
+
+func (c *Controller) handle(conn *net.UnixConn) {
+	defer conn.Close()
+	req := &ControlRequest{}
+	if err := json.NewDecoder(conn).Decode(req); err != nil {
+		d("Malformed control request: %s", err)
+		return
+	}
+	d("Control request: %s %v", req.Command, req.Services)
+	if err := json.NewEncoder(conn).Encode(c.Execute(req)); err != nil {
+		d("Cannot send control response: %s", err)
+	}
+}
+
+// Execute runs a control command
+func (c *Controller) Execute(req *ControlRequest) *ControlResponse {
+	ret := &ControlResponse{OK: true}
+	if req.Command == "status" {
+		// Supervisor has its own lock, no need to wait for running commands
+		ret.Status = c.sup.Status()
+		return ret
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	fail := func(err error) *ControlResponse {
+		ret.OK = false
+		ret.Error = err.Error()
+		return ret
+	}
+
+	switch req.Command {
+	case "start", "stop", "restart", "reload", "daemon-reload", "kill":
+	default:
+		return fail(fmt.Errorf("unknown command %s", req.Command))
+	}
+
+	if c.sup.Halted() {
+		return fail(errors.New("ynit is shutting down"))
+	}
+
+	if req.Command == "daemon-reload" {
+		report, msg, err := c.daemonReload(req.Restart || c.restart)
+		if err != nil {
+			return fail(err)
+		}
+		ret.Report, ret.Message = report, msg
+		if !report.OK() {
+			return fail(errors.New("cannot start all services"))
+		}
+		return ret
+	}
+
+	srvs, err := c.lookup(req.Services)
+	if err != nil {
+		return fail(err)
+	}
+
+	switch req.Command {
+	case "start":
+		ret.Report = c.start(srvs)
+	case "stop":
+		c.stop(srvs)
+	case "restart":
+		ret.Report = c.start(append(srvs, c.stop(srvs)...))
+	case "reload":
+		for _, srv := range srvs {
+			if err = c.sup.Reload(srv); err != nil {
+				return fail(fmt.Errorf("cannot reload %s: %s", srv.Script, err))
+			}
+			log.Printf("Service %s is reloaded", srv.Script)
+		}
+	case "kill":
+		sig, err := parseSignal(req.Signal)
+		if err != nil {
+			return fail(err)
+		}
+		for _, srv := range srvs {
+			if err = c.sup.Kill(srv, sig); err != nil {
+				return fail(fmt.Errorf("cannot send %s to %s: %s", sig, srv.Script, err))
+			}
+			log.Printf("Sent %s to %s", sig, srv.Script)
+		}
+	}
+
+	if ret.Report != nil && !ret.Report.OK() {
+		return fail(errors.New("cannot start all services"))
+	}
+	return ret
+}
+
+// lookup finds services by names
+func (c *Controller) lookup(names []string) ([]*Service, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no service specified")
+	}
+
+	ret := []*Service{}
+	for _, name := range names {
+		srvs := c.sup.Services().Lookup(name)
+		if len(srvs) == 0 {
+			return nil, fmt.Errorf("cannot find service %s", name)
+		}
+		ret = append(ret, srvs...)
+	}
+	return ret, nil
+}
+
+// start starts services which are not active, along with their inactive dependencies
+func (c *Controller) start(srvs []*Service) *Report {
+	services := c.sup.Services()
+	set := map[*Service]bool{}
+	for _, srv := range srvs {
+		set[srv] = true
+		for _, dep := range services.Dependencies(srv) {
+			set[dep] = true
+		}
+	}
+
+	list := []*Service{}
+	for srv := range set {
+		if !c.sup.Active(srv) {
+			list = append(list, srv)
+		}
+	}
+	log.Printf("Starting %d services", len(list))
+	return NewStarter(StartAfter, c.sup).Execute(services.Subset(list))
+}
+
+// stop stops active services along with services depending on them, and waits
+// until their processes exit. It returns stopped services, except those whose
+// process cannot be stopped.
+func (c *Controller) stop(srvs []*Service) []*Service {
+	services := c.sup.Services()
+	set := map[*Service]bool{}
+	for _, srv := range srvs {
+		set[srv] = true
+		for _, dep := range services.Dependents(srv) {
+			set[dep] = true
+		}
+	}
+
+	list := []*Service{}
+	for srv := range set {
+		if c.sup.Active(srv) {
+			list = append(list, srv)
+		}
+	}
+	log.Printf("Stopping %d services", len(list))
+	NewStopper(StopAfter, c.sup).Execute(services.Subset(list))
+	stopped := []*Service{}
+	for _, srv := range list {
+		if err := c.sup.WaitStopped(srv); err != nil {
+			log.Printf("Cannot stop %s: %s", srv.Script, err)
+			continue
+		}
+		stopped = append(stopped, srv)
+	}
+	return stopped
+}
+
+// daemonReload loads services from confdir again, starts new services and
+// stops removed ones. Changed services are restarted if restart is true,
+// otherwise changes take effect next time they are started.
+func (c *Controller) daemonReload(restart bool) (*Report, string, error) {
+	next, err := NewServiceManager(c.confdir)
+	if err != nil {
+		return nil, "", err
+	}
+	next.Normalize()
+	if c.main != "" {
+		if err = markMain(next, c.main); err != nil {
+			return nil, "", err
+		}
+	}
+
+	cur := c.sup.Services()
+	var added, removed, changed []string
+	for path, srv := range next.Services {
+		old, ok := cur.Services[path]
+		switch {
+		case !ok:
+			added = append(added, path)
+		case old.Digest != srv.Digest:
+			changed = append(changed, path)
+		}
+	}
+	for path := range cur.Services {
+		if _, ok := next.Services[path]; !ok {
+			removed = append(removed, path)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	msg := fmt.Sprintf("%d added, %d removed, %d changed", len(added), len(removed), len(changed))
+	log.Printf("Reloading %s: %s", c.confdir, msg)
+	for _, path := range added {
+		log.Printf("  added: %s", path)
+	}
+	for _, path := range removed {
+		log.Printf("  removed: %s", path)
+	}
+	for _, path := range changed {
+		log.Printf("  changed: %s", path)
+	}
+
+	victims := []*Service{}
+	for _, path := range removed {
+		victims = append(victims, cur.Services[path])
+	}
+	if restart {
+		for _, path := range changed {
+			victims = append(victims, cur.Services[path])
+		}
+	}
+	// services depending on victims are stopped too, and started again later
+	stopped := []*Service{}
+	if len(victims) > 0 {
+		stopped = c.stop(victims)
+	}
+
+	c.sup.Replace(next)
+	starting := []*Service{}
+	for _, path := range added {
+		starting = append(starting, next.Services[path])
+	}
+	for _, srv := range stopped {
+		if srv, ok := next.Services[srv.Script]; ok {
+			starting = append(starting, srv)
+		}
+	}
+	return c.start(starting), msg, nil
+}
+
+// Close stops accepting commands and removes the socket file
+func (c *Controller) Close() error {
+	if c.listener == nil {
+		return nil
+	}
+	return c.listener.Close()
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2016-2017 Ronmi Ren <ronmi@patrolavia.com>
+
+This file is part of YNIT.
+
+YNIT is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+YNIT is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with YNIT.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// where ynit creates runtime files and control socket by default
+const (
+	defaultRundir  = "/run/ynit"
+	defaultControl = defaultRundir + "/control.sock"
+	dialTimeout    = 5 * time.Second // ynit might be stuck, don't wait forever
+)
+
+// ctl is entry of ynitctl, which sends a command to running ynit through
+// control socket, and returns exit code
+func ctl(name string, args []string) int {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] status|start|stop|restart|reload|daemon-reload [service...]\n", name)
+		fmt.Fprintf(os.Stderr, "       %s [options] kill service... signal\n", name)
+		fs.PrintDefaults()
+	}
+	path := fs.String("control", defaultControl, "Path to control socket of ynit.")
+	jsonOut := fs.Bool("json", false, "Print status in JSON.")
+	restart := fs.Bool("restart", false, "Restart changed services after daemon-reload.")
+	timeout := fs.Duration("timeout", 0, "How long to wait for response, 0 to wait until the command is done.")
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	// options are also allowed after command, like "status --json"
+	cmd := fs.Arg(0)
+	_ = fs.Parse(fs.Args()[1:])
+
+	srvs, sig := fs.Args(), ""
+	if cmd == "kill" {
+		if len(srvs) < 2 {
+			fs.Usage()
+			return 2
+		}
+		srvs, sig = srvs[:len(srvs)-1], srvs[len(srvs)-1]
+	}
+
+	req := &ControlRequest{cmd, srvs, *restart, sig}
+	resp, err := sendControl(*path, req, *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot talk to ynit: %s\n", err)
+		return 1
+	}
+
+	if resp.Status != nil {
+		if *jsonOut {
+			data, _ := json.MarshalIndent(resp.Status, "", "  ")
+			fmt.Println(string(data))
+		} else {
+			fmt.Print(resp.Status.Table())
+		}
+	}
+	if resp.Message != "" {
+		fmt.Println(resp.Message)
+	}
+	if resp.Report != nil && !resp.Report.OK() {
+		fmt.Fprint(os.Stderr, resp.Report.Table())
+	}
+	if !resp.OK {
+		fmt.Fprintln(os.Stderr, resp.Error)
+		return 1
+	}
+	return 0
+}
+
+// health is entry of "ynit health", which checks if all required services are
+// running, ready and healthy, and returns exit code for docker HEALTHCHECK
+func health(name string, args []string) int {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	path := fs.String("control", defaultControl, "Path to control socket of ynit.")
+	file := fs.String("status", filepath.Join(defaultRundir, statusFile), "Status file to read if control socket is not available.")
+	timeout := fs.Duration("timeout", 5*time.Second, "How long to wait for control socket before reading status file.")
+	_ = fs.Parse(args)
+
+	var snapshot *Snapshot
+	resp, err := sendControl(*path, &ControlRequest{Command: "status"}, *timeout)
+	if err == nil {
+		snapshot = resp.Status
+	} else if snapshot, err = readStatus(*file); err != nil {
+		fmt.Printf("Cannot get status of services: %s\n", err)
+		return 1
+	}
+
+	problems := snapshot.Problems()
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// readStatus reads status file written by ynit
+func readStatus(file string) (*Snapshot, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	ret := &Snapshot{}
+	if err = json.Unmarshal(data, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// sendControl sends a request to control socket and waits for response.
+// It fails if the whole exchange takes longer than timeout, unless it is 0.
+func sendControl(path string, req *ControlRequest, timeout time.Duration) (*ControlResponse, error) {
+	conn, err := net.DialTimeout("unix", path, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if timeout > 0 {
+		if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	resp := &ControlResponse{}
+	if err = json.NewDecoder(conn).Decode(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2016-2017 Ronmi Ren <ronmi@patrolavia.com>
+
+This file is part of YNIT.
+
+YNIT is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+YNIT is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with YNIT.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"syscall"
+	"time"
+)
+
+// default values of health check related properties
+const (
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthRetries  = 3
+	stopTimeout           = 10 * time.Second // how long to wait before killing an unhealthy service
+)
+
+// results of health checks
+const (
+	Healthy   = "healthy"
+	Unhealthy = "unhealthy"
+)
+
+// checkHealth starts periodic health checks of a started service if needed,
+// caller must hold the lock
+func (s *Supervisor) checkHealth(srv *Service, u *unit) {
+	str := srv.Value(HealthCheck)
+	if str == "" {
+		return
+	}
+	p, err := ParseProbe(str)
+	if err != nil {
+		log.Printf("Invalid health check of %s: %s", srv.Script, err)
+		return
+	}
+
+	if u.checks == nil {
+		u.checks = make(chan bool)
+	}
+	go s.monitor(srv, u, p, u.checks)
+}
+
+// monitor runs health checks until cancel is closed, and restarts the
+// service if it fails too many times in a row
+func (s *Supervisor) monitor(srv *Service, u *unit, p Probe, cancel chan bool) {
+	interval := srv.Duration(HealthIntvl, defaultHealthInterval)
+	retries := srv.Int(HealthRetry, defaultHealthRetries)
+	timeout := interval
+	if timeout > maxProbeTimeout {
+		timeout = maxProbeTimeout
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-cancel:
+			return
+		case <-ticker.C:
+		}
+
+		err := p.Check(s.pm, timeout)
+		s.Lock()
+		select {
+		case <-cancel:
+			// stopped or restarted while checking
+			s.Unlock()
+			return
+		default:
+		}
+		if err == nil {
+			if u.health != Healthy {
+				d("Service %s is healthy", srv.Script)
+				s.changed()
+			}
+			u.health = Healthy
+			failures = 0
+			s.Unlock()
+			continue
+		}
+
+		failures++
+		log.Printf("Health check of %s failed (%d/%d): %s", srv.Script, failures, retries, err)
+		if failures < retries {
+			s.Unlock()
+			continue
+		}
+		u.health = Unhealthy
+		u.disarm()
+		s.changed()
+		s.Unlock()
+
+		log.Printf("Service %s is unhealthy, restarting", srv.Script)
+		s.heal(srv, u)
+		return
+	}
+}
+
+// heal restarts an unhealthy service, its process is killed if it does not
+// stop in time
+func (s *Supervisor) heal(srv *Service, u *unit) {
+	if err := s.Stop(srv); err != nil {
+		d("Cannot stop %s: %s", srv.Script, err)
+	}
+	err := s.WaitStopped(srv)
+
+	s.Lock()
+	if s.stopping {
+		s.Unlock()
+		return
+	}
+	if err != nil {
+		log.Printf("Cannot restart %s: %s", srv.Script, err)
+		u.state = Failed
+		s.changed()
+		s.Unlock()
+		return
+	}
+	u.stopping = false
+	u.restarts++
+	u.state = Waiting
+	s.changed()
+	s.Unlock()
+	s.restart(srv)
+}
+
+// WaitStopped waits for the process of a stopping service to exit, and kills
+// it if it takes too long. It fails if the process is still not reaped after
+// killed.
+func (s *Supervisor) WaitStopped(srv *Service) error {
+	s.Lock()
+	u := s.unit(srv)
+	s.Unlock()
+
+	deadline := time.Now().Add(stopTimeout)
+	killed := false
+	for {
+		s.Lock()
+		pid := u.pid
+		s.Unlock()
+		if pid == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			if killed {
+				return fmt.Errorf("process %d is still alive after killed", pid)
+			}
+			log.Printf("Service %s does not stop in %s, killing pid %d", srv.Script, stopTimeout, pid)
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+			killed = true
+			deadline = time.Now().Add(stopTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
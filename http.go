@@ -0,0 +1,92 @@
+/*
+Copyright 2016-2017 Ronmi Ren <ronmi@patrolavia.com>
+
+This file is part of YNIT.
+
+YNIT is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+YNIT is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with YNIT.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// how long to wait for supervisor before /livez reports failure
+const livenessTimeout = 5 * time.Second
+
+// statusHandler serves liveness, readiness, status and metrics of services over http
+type statusHandler struct {
+	sup  *Supervisor
+	logd *mysyslogd
+}
+
+// ServeHTTP starts a http server at addr, which serves /livez, /readyz, /status and /metrics
+func ServeHTTP(addr string, sup *Supervisor, logd *mysyslogd) (*http.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &statusHandler{sup, logd}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", h.livez)
+	mux.HandleFunc("/readyz", h.readyz)
+	mux.HandleFunc("/status", h.status)
+	mux.HandleFunc("/metrics", h.metrics)
+	ret := &http.Server{Handler: mux}
+	go ret.Serve(l)
+	return ret, nil
+}
+
+// livez succeeds if supervisor is not stuck
+func (h *statusHandler) livez(w http.ResponseWriter, r *http.Request) {
+	done := make(chan bool, 1)
+	go func() {
+		h.sup.Status()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		fmt.Fprintln(w, "ok")
+	case <-time.After(livenessTimeout):
+		http.Error(w, "supervisor is not responding", http.StatusServiceUnavailable)
+	}
+}
+
+// readyz succeeds if all non-optional services are running, ready and healthy
+func (h *statusHandler) readyz(w http.ResponseWriter, r *http.Request) {
+	if h.sup.Halted() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if problems := h.sup.Status().Problems(); len(problems) > 0 {
+		http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// status shows runtime status of all services in JSON
+func (h *statusHandler) status(w http.ResponseWriter, r *http.Request) {
+	data, _ := json.MarshalIndent(h.sup.Status(), "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2016-2017 Ronmi Ren <ronmi@patrolavia.com>
+
+This file is part of YNIT.
+
+YNIT is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+YNIT is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with YNIT.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// exit codes of status action defined by LSB
+const (
+	StatusRunning     = 0
+	StatusDeadPidfile = 1 // dead but pidfile exists
+	StatusDeadLock    = 2 // dead but lock file exists
+	StatusNotRunning  = 3
+	StatusUnknown     = 4
+)
+
+// exit code of other actions defined by LSB, returned if the action is not
+// supported by the script
+const lsbUnimplemented = 3
+
+// default interval of checking status of a daemon
+const defaultStatusInterval = 30 * time.Second
+
+// lsbStatus executes status action of the script, and returns its exit code
+func (s *Supervisor) lsbStatus(srv *Service) int {
+	err := s.pm.Exec(maxProbeTimeout, srv.Script, "status")
+	if err == nil {
+		return StatusRunning
+	}
+	var e *ExitError
+	if errors.As(err, &e) && e.Status.Exited() {
+		return e.Status.ExitStatus()
+	}
+	d("Cannot get status of %s: %s", srv.Script, err)
+	return StatusUnknown
+}
+
+// lsbDead tests if the status code means the daemon is not running
+func lsbDead(code int) bool {
+	return code >= StatusDeadPidfile && code <= StatusNotRunning
+}
+
+// verify checks if the daemon is running after started
+func (s *Supervisor) verify(srv *Service) error {
+	code := s.lsbStatus(srv)
+	if lsbDead(code) {
+		return fmt.Errorf("not running after start, status %d", code)
+	}
+	if code != StatusRunning {
+		log.Printf("Status of %s is unknown (%d)", srv.Script, code)
+	}
+	return nil
+}
+
+// checkStatus starts periodic status checks of a started daemon if needed,
+// caller must hold the lock
+func (s *Supervisor) checkStatus(srv *Service, u *unit) {
+	if !srv.Bool(StatusCheck) || srv.IsNonStop() || u.pid != 0 {
+		// process with known pid is watched directly
+		return
+	}
+
+	if u.checks == nil {
+		u.checks = make(chan bool)
+	}
+	go s.poll(srv, u, u.checks)
+}
+
+// poll runs status action until cancel is closed, or the daemon is not
+// running anymore
+func (s *Supervisor) poll(srv *Service, u *unit, cancel chan bool) {
+	ticker := time.NewTicker(srv.Duration(StatusIntvl, defaultStatusInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cancel:
+			return
+		case <-ticker.C:
+		}
+
+		code := s.lsbStatus(srv)
+		if !lsbDead(code) {
+			continue
+		}
+		s.Lock()
+		select {
+		case <-cancel:
+			// stopped or restarted while checking
+			s.Unlock()
+			return
+		default:
+		}
+		u.disarm()
+		s.lost(srv, u, code)
+		s.changed()
+		s.Unlock()
+		return
+	}
+}
+
+// lost handles a daemon which is found not running, caller must hold the lock
+func (s *Supervisor) lost(srv *Service, u *unit, code int) {
+	u.state = Failed
+	if srv.Bool(Main) {
+		log.Printf("Main service %s is not running (status %d), quitting", srv.Script, code)
+		s.Shutdown(1)
+		return
+	}
+
+	log.Printf("Service %s is not running (status %d)", srv.Script, code)
+	if !s.schedule(srv, u, false, time.Since(u.started)) {
+		s.dead(srv, 1)
+	}
+}
@@ -20,19 +20,30 @@ along with YNIT.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/sys/unix"
 	syslogd "gopkg.in/mcuadros/go-syslog.v2"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
 )
 
-var debug bool
+var (
+	debug       bool
+	logReaped   bool
+	waitTimeout time.Duration // default timeout of X-Wait-For targets
+)
 
 func d(fmt string, vars ...interface{}) {
 	if debug {
@@ -47,55 +58,95 @@ func dp(vars ...interface{}) {
 }
 
 type mysyslogd struct {
-	server *syslogd.Server
-	tcp    string
-	udp    string
-	unix   string
-	format string
+	servers []*syslogd.Server // one server per transport, so messages can be counted by transport
+	tcp     string
+	udp     string
+	unix    string
+	format  string
+
+	*sync.Mutex
+	received map[string]uint64 // messages received per transport
+	errors   uint64            // messages cannot be parsed
 }
 
 func (s *mysyslogd) test() bool {
 	return s.tcp != "" || s.udp != "" || s.unix != ""
 }
 
-func (s *mysyslogd) start() {
-	if !s.test() {
-		return
+// syslogHandler passes messages from a transport to channel, and counts them
+type syslogHandler struct {
+	logd      *mysyslogd
+	transport string
+	channel   syslogd.LogPartsChannel
+}
+
+func (h *syslogHandler) Handle(logParts format.LogParts, length int64, err error) {
+	h.logd.Lock()
+	h.logd.received[h.transport]++
+	if err != nil {
+		h.logd.errors++
 	}
+	h.logd.Unlock()
+	h.channel <- logParts
+}
 
-	channel := make(syslogd.LogPartsChannel)
-	handler := syslogd.NewChannelHandler(channel)
+// stats returns number of messages received per transport, and parse errors
+func (s *mysyslogd) stats() (received map[string]uint64, errors uint64) {
+	s.Lock()
+	defer s.Unlock()
+	received = map[string]uint64{}
+	for k, v := range s.received {
+		received[k] = v
+	}
+	return received, s.errors
+}
 
-	s.server = syslogd.NewServer()
+func (s *mysyslogd) newServer(transport string, channel syslogd.LogPartsChannel) *syslogd.Server {
+	server := syslogd.NewServer()
 	switch s.format {
 	case "rfc3164":
-		s.server.SetFormat(syslogd.RFC3164)
+		server.SetFormat(syslogd.RFC3164)
 	case "rfc5424":
-		s.server.SetFormat(syslogd.RFC5424)
+		server.SetFormat(syslogd.RFC5424)
 	case "rfc6587":
-		s.server.SetFormat(syslogd.RFC6587)
+		server.SetFormat(syslogd.RFC6587)
 	default:
-		s.server.SetFormat(syslogd.Automatic)
+		server.SetFormat(syslogd.Automatic)
 
 	}
-	s.server.SetHandler(handler)
+	server.SetHandler(&syslogHandler{s, transport, channel})
+	s.servers = append(s.servers, server)
+	s.Lock()
+	s.received[transport] = 0
+	s.Unlock()
+	return server
+}
+
+func (s *mysyslogd) start() {
+	if !s.test() {
+		return
+	}
+
+	channel := make(syslogd.LogPartsChannel)
 	if s.tcp != "" {
-		if err := s.server.ListenTCP(s.tcp); err != nil {
+		if err := s.newServer("tcp", channel).ListenTCP(s.tcp); err != nil {
 			log.Fatalf("Cannot create syslogd at tcp %s: %s", s.tcp, err)
 		}
 	}
 	if s.udp != "" {
-		if err := s.server.ListenUDP(s.udp); err != nil {
+		if err := s.newServer("udp", channel).ListenUDP(s.udp); err != nil {
 			log.Fatalf("Cannot create syslogd at udp %s: %s", s.udp, err)
 		}
 	}
 	if s.unix != "" {
-		if err := s.server.ListenUnixgram(s.unix); err != nil {
+		if err := s.newServer("unix", channel).ListenUnixgram(s.unix); err != nil {
 			log.Fatalf("Cannot create syslogd at unix socket path %s: %s", s.unix, err)
 		}
 	}
-	if err := s.server.Boot(); err != nil {
-		log.Fatalf("Cannot create syslogd instance: %s", err)
+	for _, server := range s.servers {
+		if err := server.Boot(); err != nil {
+			log.Fatalf("Cannot create syslogd instance: %s", err)
+		}
 	}
 
 	dp("Syslogd initialized")
@@ -125,30 +176,72 @@ func (s *mysyslogd) stop() {
 		return
 	}
 
-	_ = s.server.Kill()
+	for _, server := range s.servers {
+		_ = server.Kill()
+	}
 }
 
 func main() {
+	if name := filepath.Base(os.Args[0]); name == "ynitctl" {
+		os.Exit(ctl(name, os.Args[1:]))
+	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "ctl":
+			os.Exit(ctl("ynit ctl", os.Args[2:]))
+		case "health":
+			os.Exit(health("ynit health", os.Args[2:]))
+		}
+	}
+
 	var (
 		confdir        string
 		syslogTCPAddr  string
 		syslogUDPAddr  string
 		syslogUNIXAddr string
 		syslogFormat   string
+		mainService    string
+		exitWhenIdle   bool
+		onFailure      string
+		reportFormat   string
+		rundir         string
+		control        string
+		controlMode    string
+		controlGroup   string
+		httpAddr       string
+		reloadRestart  bool
+		watch          bool
+		watchDelay     time.Duration
 	)
 	flag.StringVar(&confdir, "confdir", "/etc/ynit", "Where to read ynit scripts.")
 	flag.StringVar(&syslogTCPAddr, "tcp", "", "TCP address:port to listen for buildin tiny syslogd, which is disabled by default.")
 	flag.StringVar(&syslogUDPAddr, "udp", "", "UDP address:port to listen for buildin tiny syslogd, which is disabled by default.")
 	flag.StringVar(&syslogUNIXAddr, "unix", "", "UNIX socket path to listen for buildin tiny syslogd, which is disabled by default.")
 	flag.StringVar(&syslogFormat, "log_format", "RFC3164", "Syslog format, can be rfc3164/rfc5424/rfc6587/auto, only valid if buildin syslogd is enabled.")
+	flag.StringVar(&mainService, "main", "", "Quit with exit code of this service when it exits, same as setting X-Main property.")
+	flag.BoolVar(&exitWhenIdle, "exit-when-idle", false, "Quit when all non-stop services are done, exit code is 1 if any of them failed.")
+	flag.StringVar(&onFailure, "on-start-failure", "abort", "What to do if any non-optional service cannot be started: abort/continue/shell.")
+	flag.StringVar(&reportFormat, "report-format", "table", "Format of the report printed when services cannot be started: table/json.")
+	flag.StringVar(&rundir, "rundir", defaultRundir, "Where to create runtime files like notify sockets.")
+	flag.DurationVar(&waitTimeout, "wait-timeout", time.Minute, "Default time to wait for each target in X-Wait-For property.")
+	flag.StringVar(&control, "control", defaultControl, "Path to control socket used by ynitctl, empty to disable it.")
+	flag.StringVar(&controlMode, "control-mode", "0600", "Permission of control socket.")
+	flag.StringVar(&controlGroup, "control-group", "", "Group name or id of control socket.")
+	flag.StringVar(&httpAddr, "http-addr", "", "Address:port to serve /livez, /readyz, /status and /metrics over http, which is disabled by default.")
+	flag.BoolVar(&reloadRestart, "reload-restart", false, "Restart changed services when reloading confdir by SIGHUP or ynitctl daemon-reload.")
+	flag.BoolVar(&watch, "watch", false, "Reload confdir automatically when files in it are changed.")
+	flag.DurationVar(&watchDelay, "watch-delay", time.Second, "Wait until no more changes for this long before reloading confdir.")
 	flag.BoolVar(&debug, "debug", false, "Enable debug output")
+	flag.BoolVar(&logReaped, "log-reaped", false, "Log pid, cmdline, owner, exit status and resource usage of every reaped process.")
 	flag.Parse()
 
 	logd := &mysyslogd{
-		tcp:    syslogTCPAddr,
-		udp:    syslogUDPAddr,
-		unix:   syslogUNIXAddr,
-		format: strings.ToLower(syslogFormat),
+		tcp:      syslogTCPAddr,
+		udp:      syslogUDPAddr,
+		unix:     syslogUNIXAddr,
+		format:   strings.ToLower(syslogFormat),
+		Mutex:    new(sync.Mutex),
+		received: map[string]uint64{},
 	}
 
 	go logd.start()
@@ -158,33 +251,172 @@ func main() {
 		log.Fatalf("Error parsing %s: %s", confdir, err)
 	}
 	services.Normalize()
+	if mainService != "" {
+		if err = markMain(services, mainService); err != nil {
+			log.Fatalf("Invalid value of -main: %s", err)
+		}
+	}
 	processes := NewPM()
+	sup := NewSupervisor(services, processes, rundir)
+
+	switch onFailure {
+	case "abort", "continue", "shell":
+	default:
+		log.Fatalf("Unknown value of -on-start-failure: %s", onFailure)
+	}
+	mode, err := strconv.ParseUint(controlMode, 8, 32)
+	if err != nil {
+		log.Fatalf("Invalid value of -control-mode: %s", controlMode)
+	}
+
+	// serve probes during boot, so it is not considered dead before ready
+	var httpd *http.Server
+	if httpAddr != "" {
+		if httpd, err = ServeHTTP(httpAddr, sup, logd); err != nil {
+			log.Printf("Cannot listen at %s: %s", httpAddr, err)
+		}
+	}
+
+	if report := NewStarter(StartAfter, sup).Execute(services); !report.OK() {
+		log.Print("Cannot start all services:")
+		if reportFormat == "json" {
+			fmt.Fprintln(os.Stderr, report.JSON())
+		} else {
+			fmt.Fprint(os.Stderr, report.Table())
+		}
 
-	if !start(services, processes) {
-		log.Print("Cannot start all services, quitting.")
-		stop(services, processes)
-		log.Fatal("Quitting")
+		switch onFailure {
+		case "abort":
+			stop(sup)
+			log.Fatal("Quitting")
+		case "shell":
+			emergencyShell(sup)
+		}
+		log.Print("Continue running other services.")
+	}
+	ctrl := NewController(sup, confdir, mainService, reloadRestart)
+	if control != "" {
+		if err = ctrl.Listen(control, os.FileMode(mode), controlGroup); err != nil {
+			log.Printf("Cannot create control socket %s: %s", control, err)
+		}
+	}
+	var watcher *ConfWatcher
+	if watch {
+		if watcher, err = WatchConfdir(confdir, watchDelay, ctrl); err != nil {
+			log.Printf("Cannot watch %s: %s", confdir, err)
+		}
 	}
 	dp("Service started, waiting for child processes")
+	if exitWhenIdle {
+		sup.QuitWhenIdle()
+	}
 
 	term := make(chan os.Signal, 1)
-	signal.Notify(term, unix.SIGTERM, unix.SIGINT)
+	if args := flag.Args(); len(args) > 0 {
+		// signals are forwarded to the command, which decides when to quit
+		go runCommand(sup, args)
+	} else {
+		signal.Notify(term, unix.SIGTERM, unix.SIGINT)
+		go ctrl.forwardSignals()
+	}
 
-	<-term
+	code := 0
+	select {
+	case <-term:
+	case code = <-sup.Done():
+	}
 	logd.stop()
-	stop(services, processes)
+	if watcher != nil {
+		_ = watcher.Close()
+	}
+	_ = ctrl.Close()
+	if httpd != nil {
+		_ = httpd.Close()
+	}
+	stop(sup)
+	os.Exit(code)
 }
 
-func start(services *ServiceManager, processes *ProcessManager) bool {
-	e := NewStarter(StartAfter, processes)
-	return e.Execute(services)
+// markMain sets X-Main property of services providing name
+func markMain(services *ServiceManager, name string) error {
+	srvs := services.Providers(name)
+	if len(srvs) == 0 {
+		return fmt.Errorf("cannot find main service %s", name)
+	}
+	for _, srv := range srvs {
+		srv.Properties[Main]["yes"] = true
+	}
+	return nil
+}
+
+// signals forwarded to the command in command mode
+var forwardSignals = []os.Signal{
+	unix.SIGTERM,
+	unix.SIGINT,
+	unix.SIGHUP,
+	unix.SIGQUIT,
+	unix.SIGUSR1,
+	unix.SIGUSR2,
+	unix.SIGWINCH,
+}
+
+// runCommand runs a command in foreground, and quits with its exit code when it is done
+func runCommand(sup *Supervisor, args []string) {
+	cmd, pid, exit, err := sup.pm.Foreground(args[0], args[1:]...)
+	if err != nil {
+		log.Printf("Cannot run %s: %s", args[0], err)
+		code := 126
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+			code = 127
+		}
+		sup.Shutdown(code)
+		return
+	}
+	d("Running %s with pid %d", args[0], pid)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, forwardSignals...)
+	go func() {
+		for sig := range sigs {
+			d("Forwarding %s to %s", sig, args[0])
+			_ = unix.Kill(pid, sig.(unix.Signal))
+		}
+	}()
+
+	st := <-exit
+	d("Command %s exited: %s", args[0], st)
+	restoreTerminal(cmd)
+	sup.Shutdown(st.Code())
+}
+
+// emergencyShell runs /bin/sh on console and waits for it
+func emergencyShell(sup *Supervisor) {
+	log.Print("Starting emergency shell, services keep running after it exits.")
+	cmd, _, exit, err := sup.pm.Foreground("/bin/sh")
+	if err != nil {
+		log.Printf("Cannot start emergency shell: %s", err)
+		return
+	}
+	<-exit
+	restoreTerminal(cmd)
+}
+
+// restoreTerminal takes the terminal back from a foreground command, so
+// output of ynit and stop scripts is not suspended
+func restoreTerminal(cmd *exec.Cmd) {
+	if !cmd.SysProcAttr.Foreground {
+		return
+	}
+	signal.Ignore(unix.SIGTTOU)
+	_ = unix.IoctlSetPointerInt(0, unix.TIOCSPGRP, unix.Getpgrp())
 }
 
-func stop(services *ServiceManager, processes *ProcessManager) {
-	e := NewStopper(StopAfter, processes)
-	e.Execute(services)
+func stop(sup *Supervisor) {
+	sup.Halt()
+	e := NewStopper(StopAfter, sup)
+	e.Execute(sup.Services())
 	dp("Service stopped, sending signal to all childs who still alive")
-	processes.Find()
-	processes.Kill()
-	processes.Wait()
+	sup.pm.Kill()
+	sup.pm.Wait()
+	sup.Close()
 }
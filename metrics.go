@@ -0,0 +1,133 @@
+/*
+Copyright 2016-2017 Ronmi Ren <ronmi@patrolavia.com>
+
+This file is part of YNIT.
+
+YNIT is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+YNIT is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with YNIT.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// all possible states, used to export state as a set of gauges
+var allStates = []State{Pending, Waiting, Running, Success, Failed, Error, Stopped}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricWriter writes metrics in Prometheus text format
+type metricWriter struct {
+	w io.Writer
+}
+
+// header writes HELP and TYPE of a metric
+func (m *metricWriter) header(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// value writes a sample, labels are pairs of label name and value
+func (m *metricWriter) value(name string, v float64, labels ...string) {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(m.w, "%s %g\n", name, v)
+}
+
+// metrics exports status of services, process manager and syslogd
+func (h *statusHandler) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m := &metricWriter{w}
+	services := h.sup.Status().Services
+
+	m.header("ynit_service_state", "gauge", "Current state of the service.")
+	for _, st := range services {
+		for _, state := range allStates {
+			v := 0.0
+			if st.State == state {
+				v = 1
+			}
+			m.value("ynit_service_state", v, "service", st.Script, "state", string(state))
+		}
+	}
+
+	m.header("ynit_service_up", "gauge", "Whether the service is running and ready.")
+	for _, st := range services {
+		v := 0.0
+		if st.Ready {
+			v = 1
+		}
+		m.value("ynit_service_up", v, "service", st.Script)
+	}
+
+	m.header("ynit_service_restarts_total", "counter", "Number of times the service is restarted.")
+	for _, st := range services {
+		m.value("ynit_service_restarts_total", float64(st.Restarts), "service", st.Script)
+	}
+
+	m.header("ynit_service_last_exit_code", "gauge", "Exit code of last exited process of the service, 128+signal if killed.")
+	for _, st := range services {
+		if st.ExitCode != nil {
+			m.value("ynit_service_last_exit_code", float64(*st.ExitCode), "service", st.Script)
+		}
+	}
+
+	m.header("ynit_service_start_duration_seconds", "gauge", "Time taken by the service to be ready last time.")
+	for _, st := range services {
+		if st.Startup > 0 {
+			m.value("ynit_service_start_duration_seconds", st.Startup, "service", st.Script)
+		}
+	}
+
+	m.header("ynit_service_health", "gauge", "Result of last health check of the service, 1 if healthy.")
+	for _, st := range services {
+		switch st.Health {
+		case Healthy:
+			m.value("ynit_service_health", 1, "service", st.Script)
+		case Unhealthy:
+			m.value("ynit_service_health", 0, "service", st.Script)
+		}
+	}
+
+	orphans, monitored := h.sup.pm.Stats()
+	m.header("ynit_reaped_orphans_total", "counter", "Number of reaped orphan processes.")
+	m.value("ynit_reaped_orphans_total", float64(orphans))
+	m.header("ynit_monitored_processes", "gauge", "Number of child processes being monitored.")
+	m.value("ynit_monitored_processes", float64(monitored))
+
+	if h.logd == nil || !h.logd.test() {
+		return
+	}
+	received, errors := h.logd.stats()
+	transports := make([]string, 0, len(received))
+	for transport := range received {
+		transports = append(transports, transport)
+	}
+	sort.Strings(transports)
+	m.header("ynit_syslog_messages_total", "counter", "Number of syslog messages received.")
+	for _, transport := range transports {
+		m.value("ynit_syslog_messages_total", float64(received[transport]), "transport", transport)
+	}
+	m.header("ynit_syslog_parse_errors_total", "counter", "Number of syslog messages which cannot be parsed.")
+	m.value("ynit_syslog_parse_errors_total", float64(errors))
+}
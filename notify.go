@@ -0,0 +1,92 @@
+/*
+Copyright 2016-2017 Ronmi Ren <ronmi@patrolavia.com>
+
+This file is part of YNIT.
+
+YNIT is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+YNIT is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with YNIT.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// NotifySocket receives sd_notify compatible datagrams from a service
+type NotifySocket struct {
+	Path string
+	conn *net.UnixConn
+}
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// notifyPath computes socket path of a service, which is unique and short enough for sockaddr_un
+func notifyPath(dir, script string) string {
+	name := unsafeChars.ReplaceAllString(filepath.Base(script), "_")
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s-%08x.sock", name, crc32.ChecksumIEEE([]byte(script))))
+}
+
+// ListenNotify creates a NotifySocket, handler is called for every datagram with parsed variables
+func ListenNotify(path string, handler func(map[string]string)) (ret *NotifySocket, err error) {
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+	_ = os.Remove(path)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return
+	}
+	// services might drop privileges before notifying
+	if err = os.Chmod(path, 0666); err != nil {
+		conn.Close()
+		return
+	}
+
+	ret = &NotifySocket{path, conn}
+	go ret.serve(handler)
+	return
+}
+
+func (n *NotifySocket) serve(handler func(map[string]string)) {
+	buf := make([]byte, 4096)
+	for {
+		l, err := n.conn.Read(buf)
+		if err != nil {
+			return
+		}
+
+		msg := map[string]string{}
+		for _, line := range strings.Split(string(buf[:l]), "\n") {
+			if idx := strings.Index(line, "="); idx > 0 {
+				msg[line[:idx]] = line[idx+1:]
+			}
+		}
+		handler(msg)
+	}
+}
+
+// Close stops receiving datagrams and removes the socket file
+func (n *NotifySocket) Close() error {
+	_ = os.Remove(n.Path)
+	return n.conn.Close()
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2016-2017 Ronmi Ren <ronmi@patrolavia.com>
+
+This file is part of YNIT.
+
+YNIT is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+YNIT is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with YNIT.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// intervals of polling a probe
+const (
+	pollInterval    = 500 * time.Millisecond
+	maxProbeTimeout = 5 * time.Second // timeout of single check
+)
+
+// Probe checks if something is available
+type Probe interface {
+	Check(pm *ProcessManager, timeout time.Duration) error
+	String() string
+}
+
+// ParseProbe creates a Probe from string like "tcp://127.0.0.1:9000",
+// "http://localhost/health", "file:/run/app.sock" or "exec:/usr/bin/check arg"
+func ParseProbe(str string) (Probe, error) {
+	switch {
+	case strings.HasPrefix(str, "tcp://"):
+		return tcpProbe(strings.TrimPrefix(str, "tcp://")), nil
+	case strings.HasPrefix(str, "http://"), strings.HasPrefix(str, "https://"):
+		return httpProbe(str), nil
+	case strings.HasPrefix(str, "file:"):
+		return fileProbe(strings.TrimPrefix(str, "file:")), nil
+	case strings.HasPrefix(str, "exec:"):
+		cmd := strings.TrimSpace(strings.TrimPrefix(str, "exec:"))
+		if cmd == "" {
+			return nil, errors.New("no command to execute")
+		}
+		return execProbe(cmd), nil
+	}
+	return nil, fmt.Errorf("unknown probe %s", str)
+}
+
+// probe types recognized by ParseProbe
+var probePrefixes = []string{"tcp://", "http://", "https://", "file:", "exec:"}
+
+// SplitProbes splits a list of probes separated by spaces. Words not starting
+// with a probe type are arguments of previous one, like "exec:check --quiet".
+func SplitProbes(str string) []string {
+	ret := []string{}
+	for _, word := range strings.Fields(str) {
+		isProbe := len(ret) == 0
+		for _, prefix := range probePrefixes {
+			if strings.HasPrefix(word, prefix) {
+				isProbe = true
+				break
+			}
+		}
+		if isProbe {
+			ret = append(ret, word)
+			continue
+		}
+		ret[len(ret)-1] += " " + word
+	}
+	return ret
+}
+
+// ParseWaitTarget parses a probe with optional timeout suffix like
+// "tcp://db:5432#30s", def is used if no timeout is given
+func ParseWaitTarget(str string, def time.Duration) (Probe, time.Duration, error) {
+	if idx := strings.LastIndex(str, "#"); idx > 0 {
+		if t, err := parseDuration(str[idx+1:]); err == nil {
+			str, def = str[:idx], t
+		}
+	}
+	p, err := ParseProbe(str)
+	return p, def, err
+}
+
+// Poll checks the probe repeatedly until it succeeds, timeout or cancel is closed
+func Poll(p Probe, pm *ProcessManager, timeout time.Duration, cancel <-chan bool) (err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		t := time.Until(deadline)
+		switch {
+		case t > maxProbeTimeout:
+			t = maxProbeTimeout
+		case t < pollInterval: // last check should have a chance to succeed
+			t = pollInterval
+		}
+		if err = p.Check(pm, t); err == nil {
+			return
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return fmt.Errorf("%s is not available after %s: %s", p, timeout, err)
+		}
+		if wait > pollInterval {
+			wait = pollInterval
+		}
+		select {
+		case <-cancel:
+			return fmt.Errorf("canceled while waiting for %s: %s", p, err)
+		case <-time.After(wait):
+		}
+	}
+}
+
+// tcpProbe succeeds if the address accepts tcp connection
+type tcpProbe string
+
+func (p tcpProbe) Check(pm *ProcessManager, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", string(p), timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (p tcpProbe) String() string {
+	return "tcp://" + string(p)
+}
+
+// httpProbe succeeds if GET request to the url returns 2xx or 3xx
+type httpProbe string
+
+func (p httpProbe) Check(pm *ProcessManager, timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(string(p))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+func (p httpProbe) String() string {
+	return string(p)
+}
+
+// fileProbe succeeds if the file exists
+type fileProbe string
+
+func (p fileProbe) Check(pm *ProcessManager, timeout time.Duration) error {
+	_, err := os.Stat(string(p))
+	return err
+}
+
+func (p fileProbe) String() string {
+	return "file:" + string(p)
+}
+
+// execProbe succeeds if the shell command exits with status 0
+type execProbe string
+
+func (p execProbe) Check(pm *ProcessManager, timeout time.Duration) error {
+	return pm.Exec(timeout, "/bin/sh", "-c", string(p))
+}
+
+func (p execProbe) String() string {
+	return "exec:" + string(p)
+}
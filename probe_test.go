@@ -0,0 +1,110 @@
+/*
+Copyright 2016-2017 Ronmi Ren <ronmi@patrolavia.com>
+
+This file is part of YNIT.
+
+YNIT is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+YNIT is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with YNIT.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitProbes(t *testing.T) {
+	cases := map[string][]string{
+		"":                        {},
+		"tcp://db:5432#30s":       {"tcp://db:5432#30s"},
+		" tcp://db:5432  file:/a": {"tcp://db:5432", "file:/a"},
+		"exec:pg_isready -h db -q#10s http://search:9200/": {
+			"exec:pg_isready -h db -q#10s",
+			"http://search:9200/",
+		},
+	}
+	for str, expect := range cases {
+		if actual := SplitProbes(str); !reflect.DeepEqual(actual, expect) {
+			t.Errorf("SplitProbes(%q): expected %q, got %q", str, expect, actual)
+		}
+	}
+}
+
+func TestParseWaitTarget(t *testing.T) {
+	cases := []struct {
+		str     string
+		probe   string
+		timeout time.Duration
+	}{
+		{"tcp://db:5432", "tcp://db:5432", time.Minute},
+		{"tcp://db:5432#30s", "tcp://db:5432", 30 * time.Second},
+		{"tcp://db:5432#1.5", "tcp://db:5432", 1500 * time.Millisecond},
+		{"http://web/#top", "http://web/#top", time.Minute},
+		{"exec:check --quiet#5s", "exec:check --quiet", 5 * time.Second},
+	}
+	for _, c := range cases {
+		p, timeout, err := ParseWaitTarget(c.str, time.Minute)
+		if err != nil {
+			t.Errorf("ParseWaitTarget(%q): unexpected error: %s", c.str, err)
+			continue
+		}
+		if p.String() != c.probe || timeout != c.timeout {
+			t.Errorf("ParseWaitTarget(%q): expected %s with %s, got %s with %s", c.str, c.probe, c.timeout, p, timeout)
+		}
+	}
+
+	if _, _, err := ParseWaitTarget("udp://db:53", time.Minute); err == nil {
+		t.Error("ParseWaitTarget(udp://db:53): expected error")
+	}
+}
+
+func TestPollListening(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer l.Close()
+
+	p, timeout, err := ParseWaitTarget("tcp://"+l.Addr().String()+"#2s", time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err = Poll(p, nil, timeout, nil); err != nil {
+		t.Errorf("expected %s to be available, got %s", p, err)
+	}
+}
+
+func TestPollTimeout(t *testing.T) {
+	// find a port nobody listens
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	p, timeout, err := ParseWaitTarget("tcp://"+addr+"#1s", time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	begin := time.Now()
+	if err = Poll(p, nil, timeout, nil); err == nil {
+		t.Fatalf("expected %s to be unavailable", p)
+	}
+	if elapsed := time.Since(begin); elapsed < timeout || elapsed > timeout+time.Second {
+		t.Errorf("expected to give up after %s, got %s", timeout, elapsed)
+	}
+}
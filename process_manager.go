@@ -21,7 +21,10 @@ package main
 
 import (
 	"bufio"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -29,6 +32,8 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
@@ -36,11 +41,78 @@ import (
 // PROC denotes procfs root
 const PROC = "/proc"
 
-// ProcessManager manages adopted processes
+// clock ticks per second used by procfs, which is fixed to 100 on linux
+const userHZ = 100
+
+// ExitStatus holds what wait4 tells us about a reaped process
+type ExitStatus struct {
+	Pid     int
+	Status  unix.WaitStatus
+	Rusage  unix.Rusage
+	Cmdline string        // might be empty for orphans if reap logging is disabled
+	Owner   string        // script of the service which the process belongs to, if known
+	Runtime time.Duration // zero if unknown
+}
+
+// Success reports whether the process exited with status 0
+func (s *ExitStatus) Success() bool {
+	return s.Status.Exited() && s.Status.ExitStatus() == 0
+}
+
+// Code returns exit code of the process, or 128+signal if it was killed by a signal
+func (s *ExitStatus) Code() int {
+	if s.Status.Signaled() {
+		return 128 + int(s.Status.Signal())
+	}
+	return s.Status.ExitStatus()
+}
+
+func (s *ExitStatus) String() string {
+	if s.Status.Signaled() {
+		return "killed by " + unix.SignalName(s.Status.Signal())
+	}
+	return "exit status " + strconv.Itoa(s.Status.ExitStatus())
+}
+
+// Log writes a structured log line describing the process
+func (s *ExitStatus) Log() {
+	status := "exit:" + strconv.Itoa(s.Status.ExitStatus())
+	if s.Status.Signaled() {
+		status = "signal:" + unix.SignalName(s.Status.Signal())
+	}
+	log.Printf(
+		"reaped pid=%d cmd=%q service=%q status=%s core=%t runtime=%s maxrss=%dKiB utime=%s stime=%s",
+		s.Pid, s.Cmdline, s.Owner, status, s.Status.CoreDump(), s.Runtime,
+		s.Rusage.Maxrss,
+		time.Duration(s.Rusage.Utime.Nano()), time.Duration(s.Rusage.Stime.Nano()),
+	)
+}
+
+// ExitError is returned by Run if the command does not exit successfully
+type ExitError struct {
+	*ExitStatus
+	Output []string // last lines of output
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("process %d %s", e.Pid, e.ExitStatus)
+}
+
+// ProcessManager reaps child processes and dispatches their exit status
 type ProcessManager struct {
 	*sync.Mutex
-	monitoring map[int]bool
-	*sync.WaitGroup
+	monitoring map[int]bool // pids started by Run or Child which are not reaped yet
+	waiters    map[int]*waiter
+	groups     map[int]string // process group id => owner
+	orphans    uint64         // number of reaped orphan processes
+}
+
+// waiter is the owner of a process started by Run or Child
+type waiter struct {
+	exit    chan *ExitStatus
+	cmdline string
+	owner   string
+	started time.Time
 }
 
 // NewPM creates new ProcessManager instance
@@ -48,139 +120,472 @@ func NewPM() *ProcessManager {
 	ret := &ProcessManager{
 		&sync.Mutex{},
 		map[int]bool{},
-		&sync.WaitGroup{},
+		map[int]*waiter{},
+		map[int]string{},
+		0,
 	}
 
+	// orphans of our children should be reparented to us even if we are not pid 1
+	if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+		d("Cannot become child subreaper: %s", err)
+	}
+
+	// register before forking anything, or SIGCHLD of early exited children is lost
+	chld := make(chan os.Signal, 1)
+	signal.Notify(chld, unix.SIGCHLD)
+	ret.reap()
 	go func(p *ProcessManager) {
-		chld := make(chan os.Signal, 1)
-		signal.Notify(chld, unix.SIGCHLD)
 		for range chld {
-			p.Find()
+			p.reap()
 		}
 	}(ret)
 	return ret
 }
 
-// Run a command in subprocess without adopting it again, and wait until it done.
-func (m *ProcessManager) Run(script, arg string) (err error) {
-	cmd := exec.Command(script, arg)
-	cmd.Stdout = os.Stderr // redirect to stderr so you can see it in docker logs
-	cmd.Stderr = os.Stderr
+// Run a command in subprocess with extra environment variables, and wait until it done.
+// Last lines of output are kept in returned ExitError.
+func (m *ProcessManager) Run(script, arg string, env ...string) (err error) {
+	// redirect to stderr so you can see it in docker logs
+	return m.run(os.Stderr, 0, env, script, arg)
+}
+
+// Exec runs a command in subprocess, and wait until it done or timeout, output is discarded.
+// The command and processes forked by it are killed if timeout.
+func (m *ProcessManager) Exec(timeout time.Duration, name string, args ...string) error {
+	return m.run(ioutil.Discard, timeout, nil, name, args...)
+}
+
+func (m *ProcessManager) run(dst io.Writer, timeout time.Duration, env []string, name string, args ...string) (err error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	defer w.Close()
+	cmd := m.command(env, name, args...)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	out := newTail(outputLines)
+	go out.copy(dst, r)
+
 	m.Lock()
-	defer m.Unlock()
 	if err = cmd.Start(); err != nil {
+		m.Unlock()
 		return
 	}
 	pid := cmd.Process.Pid
-	m.monitoring[pid] = true
+	exit := m.watch(cmd, name)
 	m.Unlock()
-	err = cmd.Wait()
-	m.Lock()
-	m.monitoring[pid] = false
+	w.Close()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var st *ExitStatus
+	select {
+	case st = <-exit:
+	case <-expired:
+		// kill whole process group, which is created by command()
+		_ = syscall.Kill(-pid, syscall.SIGKILL)
+		st = <-exit
+	}
+	lines := out.wait(outputWait)
+	out.stop()
+	if dst == ioutil.Discard {
+		// nobody needs the output, don't let processes left behind hold the pipe
+		_ = r.Close()
+	}
+	if !st.Success() {
+		err = &ExitError{st, lines}
+	}
 	return
 }
 
-// Child runs a command in subprocess without adopting it again.
-// Child will not wait subprocess finish.
-func (m *ProcessManager) Child(script string) (cmd *exec.Cmd, err error) {
-	cmd = exec.Command(script)
-	cmd.Stdout = os.Stderr // redirect to stderr so you can see it in docker logs
+// how many lines of output are kept by Run, and how long to wait for them
+const (
+	outputLines = 10
+	outputWait  = 100 * time.Millisecond
+)
+
+// tail copies output of a subprocess and keeps last lines of it
+type tail struct {
+	*sync.Mutex
+	lines []string
+	max   int
+	done  chan bool
+}
+
+func newTail(max int) *tail {
+	return &tail{
+		new(sync.Mutex),
+		make([]string, 0, max),
+		max,
+		make(chan bool),
+	}
+}
+
+// copy reads from r until EOF or r is closed. Daemons forked by the command
+// might hold the pipe, so it keeps forwarding their output after stopped.
+func (t *tail) copy(dst io.Writer, r io.ReadCloser) {
+	defer close(t.done)
+	defer r.Close()
+	buf := bufio.NewReader(r)
+	for {
+		line, err := buf.ReadString('\n')
+		if line != "" {
+			_, _ = io.WriteString(dst, line)
+			t.Lock()
+			if t.max > 0 {
+				if len(t.lines) == t.max {
+					t.lines = t.lines[1:]
+				}
+				t.lines = append(t.lines, strings.TrimRight(line, "\r\n"))
+			}
+			t.Unlock()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// stop keeps no more lines, as output after the command exits is not of it
+func (t *tail) stop() {
+	t.Lock()
+	defer t.Unlock()
+	t.max = 0
+	t.lines = nil
+}
+
+// wait returns lines copied when EOF is reached, or timeout
+func (t *tail) wait(timeout time.Duration) []string {
+	select {
+	case <-t.done:
+	case <-time.After(timeout):
+	}
+	t.Lock()
+	defer t.Unlock()
+	return append([]string(nil), t.lines...)
+}
+
+// Child runs a command in subprocess with extra environment variables, without waiting it finish.
+// Exit status is sent to returned channel once the process is reaped. Use returned pid instead of
+// cmd.Process.Pid, which is not safe to read after the process is reaped.
+func (m *ProcessManager) Child(script string, env ...string) (cmd *exec.Cmd, pid int, exit <-chan *ExitStatus, err error) {
+	return m.child(m.command(env, script), script)
+}
+
+// ChildPid is like Child, but also exports pid of the process to script as environment
+// variable key. The script is executed by a shell as pid is not known before forking.
+func (m *ProcessManager) ChildPid(key, script string, env ...string) (cmd *exec.Cmd, pid int, exit <-chan *ExitStatus, err error) {
+	return m.child(m.command(env, "/bin/sh", "-c", key+`=$$ exec "$0"`, script), script)
+}
+
+// child starts cmd and watches it as a process of script
+func (m *ProcessManager) child(cmd *exec.Cmd, script string) (*exec.Cmd, int, <-chan *ExitStatus, error) {
+	m.Lock()
+	defer m.Unlock()
+	if err := cmd.Start(); err != nil {
+		return cmd, 0, nil, err
+	}
+	return cmd, cmd.Process.Pid, m.watch(cmd, script), nil
+}
+
+// Foreground runs a command with stdin, stdout and stderr attached, without waiting it finish.
+// If stdin is a terminal, the command becomes foreground process group of it.
+func (m *ProcessManager) Foreground(name string, args ...string) (cmd *exec.Cmd, pid int, exit <-chan *ExitStatus, err error) {
+	cmd = exec.Command(name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if _, err := unix.IoctlGetTermios(0, unix.TCGETS); err == nil {
+		cmd.SysProcAttr.Foreground = true
+		cmd.SysProcAttr.Ctty = 0
+	}
 	m.Lock()
 	defer m.Unlock()
 	if err = cmd.Start(); err != nil {
 		return
 	}
-	pid := cmd.Process.Pid
-	m.monitoring[pid] = true
-	go func(cmd *exec.Cmd) {
-		_ = cmd.Wait()
-		m.Lock()
-		defer m.Unlock()
-		m.monitoring[pid] = false
-	}(cmd)
+	pid = cmd.Process.Pid
+	exit = m.watch(cmd, name)
 	return
 }
 
-// Find out adopted processes
-func (m *ProcessManager) Find() {
+// Watch registers a process which is not started by us (like a daemon forked by a
+// start script and reparented to us), so its exit status can be dispatched to caller.
+func (m *ProcessManager) Watch(pid int, owner string) (exit <-chan *ExitStatus, err error) {
 	m.Lock()
 	defer m.Unlock()
-	myid := os.Getpid()
-	fis, err := ioutil.ReadDir(PROC)
-	if err != nil {
-		return
+	if w, ok := m.waiters[pid]; ok {
+		return nil, fmt.Errorf("process %d is already watched by %s", pid, w.owner)
+	}
+	// zombies are still there until reaped, so this also tells if it is too late
+	if err = unix.Kill(pid, 0); err != nil {
+		return nil, fmt.Errorf("process %d is not running: %s", pid, err)
+	}
+	if !m.descendant(pid) {
+		return nil, fmt.Errorf("process %d is not forked by us", pid)
 	}
 
-	for _, fi := range fis {
-		if !fi.IsDir() {
+	cmdline, _, runtime := m.inspect(pid)
+	w := &waiter{
+		make(chan *ExitStatus, 1),
+		cmdline,
+		owner,
+		time.Now().Add(-runtime),
+	}
+	m.monitoring[pid] = true
+	m.waiters[pid] = w
+	return w.exit, nil
+}
+
+// descendant tests if pid is forked by us directly or indirectly, which is
+// reaped by us (as parent or subreaper) once it exits
+func (m *ProcessManager) descendant(pid int) bool {
+	me := os.Getpid()
+	if me == 1 {
+		return true
+	}
+	for pid > 1 {
+		stat, err := ioutil.ReadFile(PROC + "/" + strconv.Itoa(pid) + "/stat")
+		if err != nil {
+			return false
+		}
+		// format: pid (comm) state ppid ...
+		str := string(stat)
+		fields := strings.Fields(str[strings.LastIndex(str, ")")+1:])
+		if len(fields) < 2 {
+			return false
+		}
+		if pid, err = strconv.Atoi(fields[1]); err != nil {
+			return false
+		}
+		if pid == me {
+			return true
+		}
+	}
+	return false
+}
+
+// command prepares a subprocess in its own process group, so processes forked
+// by it can be traced back to the owner even after they are orphaned.
+func (m *ProcessManager) command(env []string, script string, args ...string) *exec.Cmd {
+	cmd := exec.Command(script, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdout = os.Stderr // redirect to stderr so you can see it in docker logs
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
+// watch registers a started process, caller must hold the lock
+func (m *ProcessManager) watch(cmd *exec.Cmd, owner string) <-chan *ExitStatus {
+	pid := cmd.Process.Pid
+	w := &waiter{
+		make(chan *ExitStatus, 1),
+		strings.Join(cmd.Args, " "),
+		owner,
+		time.Now(),
+	}
+	m.monitoring[pid] = true
+	m.waiters[pid] = w
+	m.groups[pid] = owner
+	return w.exit
+}
+
+// reap collects exit status of all exited children without blocking.
+// It returns false if there is no child left.
+func (m *ProcessManager) reap() bool {
+	m.Lock()
+	defer m.Unlock()
+	for {
+		st := &ExitStatus{}
+		target := -1
+		if logReaped {
+			// procfs entry disappears once reaped, so read it before that
+			if pid := zombie(); pid > 0 {
+				target = pid
+				st.Cmdline, st.Owner, st.Runtime = m.inspect(pid)
+			}
+		}
+
+		pid, err := unix.Wait4(target, &st.Status, unix.WNOHANG, &st.Rusage)
+		if err == unix.EINTR {
 			continue
 		}
+		if err != nil {
+			if err != unix.ECHILD {
+				d("Cannot reap child processes: %s", err)
+			}
+			return false
+		}
+		if pid <= 0 {
+			// children exist, but none has exited
+			return true
+		}
 
-		m.adopt(myid, fi.Name())
+		st.Pid = pid
+		m.dispatch(st)
 	}
 }
 
-// check if it is child process, adopt if yes and yet adopted
-func (m *ProcessManager) adopt(myid int, name string) {
-	pid, err := strconv.Atoi(name)
-	if err != nil || pid <= 1 {
-		// not child process
-		return
+// dispatch sends exit status to the owner of pid, caller must hold the lock
+func (m *ProcessManager) dispatch(st *ExitStatus) {
+	delete(m.monitoring, st.Pid)
+	if w, ok := m.waiters[st.Pid]; ok {
+		delete(m.waiters, st.Pid)
+		st.Cmdline, st.Owner, st.Runtime = w.cmdline, w.owner, time.Since(w.started)
+		w.exit <- st
+		d("Child process %d %s", st.Pid, st)
+	} else {
+		// orphan processes reparented to us
+		m.orphans++
+		d("Orphan process %d %s", st.Pid, st)
 	}
 
-	if m.monitoring[pid] {
-		// already monitoring
-		return
+	if logReaped {
+		st.Log()
 	}
+	m.forget()
+}
 
-	if !m.isChild(myid, name) {
-		// not child process
-		return
+// forget removes process groups which have no process left, so the map does
+// not grow forever, caller must hold the lock. Groups are kept after leader
+// exits, as daemons forked by it are still owned by the service.
+func (m *ProcessManager) forget() {
+	for pgid := range m.groups {
+		if err := unix.Kill(-pgid, 0); err == unix.ESRCH {
+			delete(m.groups, pgid)
+		}
+	}
+}
+
+// childInfo is siginfo_t filled by waitid(2) for child processes, which is
+// opaque in unix.Siginfo
+type childInfo struct {
+	Signo  int32
+	Errno  int32
+	Code   int32
+	_      [unsafe.Sizeof(uintptr(0)) - 4]byte // union is aligned to pointer size
+	Pid    int32
+	UID    uint32
+	Status int32
+	_      [unsafe.Sizeof(unix.Siginfo{}) - 3*4 - (unsafe.Sizeof(uintptr(0)) - 4) - 3*4]byte
+}
+
+// zombie finds an exited child without reaping it, returns 0 if none
+func zombie() int {
+	var info unix.Siginfo
+	err := unix.Waitid(unix.P_ALL, 0, &info, unix.WEXITED|unix.WNOHANG|unix.WNOWAIT, nil)
+	if err != nil || info.Signo == 0 {
+		return 0
+	}
+	return int((*childInfo)(unsafe.Pointer(&info)).Pid)
+}
+
+// inspect reads cmdline, owner and runtime of a not yet reaped process from procfs
+func (m *ProcessManager) inspect(pid int) (cmdline, owner string, runtime time.Duration) {
+	dir := PROC + "/" + strconv.Itoa(pid)
+	if cmds, err := ioutil.ReadFile(dir + "/cmdline"); err == nil {
+		cmdline = strings.TrimSpace(strings.Replace(string(cmds), "\x00", " ", -1))
 	}
 
-	p, err := os.FindProcess(pid)
+	stat, err := ioutil.ReadFile(dir + "/stat")
 	if err != nil {
 		return
 	}
+	// format: pid (comm) state ppid pgrp ... with starttime at field 22
+	str := string(stat)
+	idx := strings.LastIndex(str, ")")
+	if idx < 0 {
+		return
+	}
+	if cmdline == "" {
+		// zombies have no cmdline
+		cmdline = "[" + str[strings.Index(str, "(")+1:idx] + "]"
+	}
+	fields := strings.Fields(str[idx+1:])
+	if len(fields) < 20 {
+		return
+	}
+	if pgid, err := strconv.Atoi(fields[2]); err == nil {
+		owner = m.groups[pgid]
+	}
 
-	m.monitoring[pid] = true
-	m.Add(1)
-	go m.reap(p, pid)
-
-	// fetch cmdline
-	cmd := ""
-	if cmds, err := ioutil.ReadFile(PROC + "/" + name + "/cmdline"); err == nil {
-		cmd = strings.Replace(string(cmds), "\x00", " ", -1)
+	uptime, err := ioutil.ReadFile(PROC + "/uptime")
+	if err != nil {
+		return
+	}
+	up, err1 := strconv.ParseFloat(strings.Fields(string(uptime))[0], 64)
+	start, err2 := strconv.ParseFloat(fields[19], 64)
+	if err1 == nil && err2 == nil {
+		runtime = time.Duration((up - start/userHZ) * float64(time.Second))
 	}
-	d("Monitoring child %d %s", pid, cmd)
+	return
+}
+
+// Stats returns number of reaped orphan processes, and processes being monitored
+func (m *ProcessManager) Stats() (orphans uint64, monitored int) {
+	m.Lock()
+	defer m.Unlock()
+	return m.orphans, len(m.monitoring)
 }
 
-// Kill a subprocess
+// Kill sends SIGINT to all child processes still alive
 func (m *ProcessManager) Kill() {
 	m.Lock()
 	defer m.Unlock()
-	for pid, ok := range m.monitoring {
-		if !ok {
+	pids := m.children()
+	for pid := range m.monitoring {
+		pids[pid] = true
+	}
+
+	for pid := range pids {
+		d("Sending SIGINT to %d", pid)
+		_ = syscall.Kill(pid, syscall.SIGINT)
+	}
+}
+
+// Wait blocks until all child processes are reaped
+func (m *ProcessManager) Wait() {
+	for m.reap() {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// children lists our child processes by parsing procfs.
+// This is only used when shutting down, as reaping does not need it.
+func (m *ProcessManager) children() map[int]bool {
+	ret := map[int]bool{}
+	myid := os.Getpid()
+	fis, err := ioutil.ReadDir(PROC)
+	if err != nil {
+		return ret
+	}
+
+	for _, fi := range fis {
+		if !fi.IsDir() {
 			continue
 		}
 
-		p, err := os.FindProcess(pid)
-		if err != nil {
+		pid, err := strconv.Atoi(fi.Name())
+		if err != nil || pid <= 1 {
+			// not a process
 			continue
 		}
-		p.Signal(syscall.SIGINT)
-	}
-}
 
-// reap a child process
-func (m *ProcessManager) reap(p *os.Process, pid int) {
-	_, _ = p.Wait()
-	m.Lock()
-	m.monitoring[pid] = false
-	m.Unlock()
-	m.Done()
-	d("Child process %d exited", pid)
+		if m.isChild(myid, fi.Name()) {
+			ret[pid] = true
+		}
+	}
+	return ret
 }
 
 // isChild parses /proc/*pid*/status to find and compare ppid
@@ -0,0 +1,137 @@
+/*
+Copyright 2016-2017 Ronmi Ren <ronmi@patrolavia.com>
+
+This file is part of YNIT.
+
+YNIT is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+YNIT is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with YNIT.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ServiceReport describes how a service is started
+type ServiceReport struct {
+	Script   string   `json:"script"`
+	State    State    `json:"state"`
+	Optional bool     `json:"optional"`
+	ExitCode *int     `json:"exit_code,omitempty"`
+	Signal   string   `json:"signal,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Duration float64  `json:"duration"`         // in seconds
+	Output   []string `json:"output,omitempty"` // last lines of output
+	Cause    []string `json:"cause,omitempty"`  // dependency chain to the failed service, only for error state
+}
+
+// Report is result of Starter.Execute
+type Report struct {
+	Services []*ServiceReport `json:"services"`
+}
+
+// newServiceReport creates a ServiceReport from result of start action
+func newServiceReport(srv *Service, state State, res *ExecuteResult) *ServiceReport {
+	ret := &ServiceReport{
+		Script:   srv.Script,
+		State:    state,
+		Optional: srv.Bool(Optional),
+	}
+	if res == nil {
+		return ret
+	}
+
+	ret.Duration = res.Duration.Seconds()
+	if res.Err == nil {
+		return ret
+	}
+	ret.Error = res.Err.Error()
+	var exitErr *ExitError
+	if errors.As(res.Err, &exitErr) {
+		ret.Output = exitErr.Output
+		if exitErr.Status.Signaled() {
+			ret.Signal = unix.SignalName(exitErr.Status.Signal())
+		} else {
+			code := exitErr.Status.ExitStatus()
+			ret.ExitCode = &code
+		}
+	}
+	return ret
+}
+
+// OK reports whether all non-optional services are started
+func (r *Report) OK() bool {
+	for _, srv := range r.Services {
+		if !srv.Optional && (srv.State == Failed || srv.State == Error) {
+			return false
+		}
+	}
+	return true
+}
+
+// JSON encodes the report
+func (r *Report) JSON() string {
+	data, _ := json.MarshalIndent(r, "", "  ")
+	return string(data)
+}
+
+// Table formats the report as human readable table, followed by details of failures
+func (r *Report) Table() string {
+	buf := &bytes.Buffer{}
+	w := tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tSTATE\tSTATUS\tDURATION")
+	for _, srv := range r.Services {
+		status := "-"
+		switch {
+		case srv.Signal != "":
+			status = "killed by " + srv.Signal
+		case srv.ExitCode != nil:
+			status = fmt.Sprintf("exit status %d", *srv.ExitCode)
+		case srv.Error != "":
+			status = "error"
+		}
+		dur := time.Duration(srv.Duration * float64(time.Second)).Round(time.Millisecond)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", srv.Script, srv.State, status, dur)
+	}
+	w.Flush()
+
+	for _, srv := range r.Services {
+		switch {
+		case len(srv.Cause) > 0:
+			fmt.Fprintf(buf, "\n%s is not started: %s\n", srv.Script, strings.Join(srv.Cause, " -> "))
+		case srv.State == Failed:
+			fmt.Fprintf(buf, "\n%s failed: %s\n", srv.Script, srv.Error)
+			for _, line := range srv.Output {
+				fmt.Fprintf(buf, "    %s\n", line)
+			}
+		}
+	}
+	return buf.String()
+}
+
+// sort services by script path
+func (r *Report) sort() {
+	sort.Slice(r.Services, func(i, j int) bool {
+		return r.Services[i].Script < r.Services[j].Script
+	})
+}
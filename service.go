@@ -21,8 +21,14 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"io"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // State of service
@@ -36,6 +42,7 @@ const (
 	Running State = "running"
 	Success State = "success"
 	Failed  State = "failed"
+	Stopped State = "stopped" // stopped by us after started
 )
 
 // Property of service
@@ -49,25 +56,99 @@ const (
 	StartBefore Property = "# X-Start-Before:"
 	StopAfter   Property = "# X-Stop-After:"
 	NonStop     Property = "# Non-Stop:"
+	Pidfile     Property = "# X-Pidfile:"
+	Restart     Property = "# X-Restart:"
+	RestartSec  Property = "# X-Restart-Sec:"
+	LimitBurst  Property = "# X-Start-Limit-Burst:"
+	LimitIntvl  Property = "# X-Start-Limit-Interval:"
+	FailAction  Property = "# X-Failure-Action:"
+	Main        Property = "# X-Main:"
+	Critical    Property = "# X-Critical:"
+	Optional    Property = "# X-Optional:"
+	Retries     Property = "# X-Start-Retries:"
+	RetryDelay  Property = "# X-Retry-Delay:"
+	Type        Property = "# X-Type:"
+	ReadyTime   Property = "# X-Ready-Timeout:"
+	ReadyCheck  Property = "# X-Ready-Check:"
+	WaitFor     Property = "# X-Wait-For:"
+	HealthCheck Property = "# X-Health-Check:"
+	HealthIntvl Property = "# X-Health-Interval:"
+	HealthRetry Property = "# X-Health-Retries:"
+	WatchdogSec Property = "# X-Watchdog-Sec:"
+	ReloadSig   Property = "# X-Reload-Signal:"
+	ForwardSig  Property = "# X-Forward-Signals:"
+	StatusCheck Property = "# X-Status-Check:"
+	StatusIntvl Property = "# X-Status-Interval:"
 )
 
 // all properties
 var (
-	Props = []Property{
-		Provides, // this will always lay on element 0
-		NonStop,  // this will always lay on element 1
+	// DepProps are properties describing dependencies between services
+	DepProps = []Property{
 		StartAfter,
 		StopBefore,
 		StartBefore,
 		StopAfter,
 	}
+
+	Props = append([]Property{
+		Provides,
+		NonStop,
+		Pidfile,
+		Restart,
+		RestartSec,
+		LimitBurst,
+		LimitIntvl,
+		FailAction,
+		Main,
+		Critical,
+		Optional,
+		Retries,
+		RetryDelay,
+		Type,
+		ReadyTime,
+		ReadyCheck,
+		WaitFor,
+		HealthCheck,
+		HealthIntvl,
+		HealthRetry,
+		WatchdogSec,
+		ReloadSig,
+		ForwardSig,
+		StatusCheck,
+		StatusIntvl,
+	}, DepProps...)
+)
+
+// properties which are probes might contain spaces, like
+// "exec:/usr/bin/check --quiet", so they are also kept unsplitted
+var rawProps = map[Property]bool{
+	ReadyCheck:  true,
+	WaitFor:     true,
+	HealthCheck: true,
+}
+
+// restart policies
+const (
+	RestartNo        = "no"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// actions to take when a service is restarted too often
+const (
+	FailIgnore         = "ignore"
+	FailExit           = "exit"
+	FailStopDependents = "stop-dependents"
 )
 
 // Service info
 type Service struct {
 	Properties map[Property]map[string]bool
 	Script     string
-	Process    *os.Process // only valid for non-stop tasks
+	Raw        map[Property]string // unsplitted value of properties in rawProps
+	Digest     [sha256.Size]byte   // checksum of the script, to detect changes
+	Reloadable bool                // script implements reload action
 }
 
 // NewService creates a Service instance by parsing script
@@ -87,14 +168,23 @@ func NewService(script string) (ret *Service, err error) {
 	ret = &Service{
 		props,
 		script,
-		nil,
+		map[Property]string{},
+		[sha256.Size]byte{},
+		false,
 	}
 
-	scanner := bufio.NewScanner(f)
+	h := sha256.New()
+	scanner := bufio.NewScanner(io.TeeReader(f, h))
 	begin := false
+	end := false
+	lines := []string{}
 
 	for scanner.Scan() {
 		line := scanner.Text()
+		lines = append(lines, line)
+		if end {
+			continue
+		}
 		if !begin {
 			if strings.TrimRight(line, " \t\r\n") == "### BEGIN INIT INFO" {
 				begin = true
@@ -103,7 +193,8 @@ func NewService(script string) (ret *Service, err error) {
 		}
 
 		if strings.TrimRight(line, " \t\r\n") == "### END INIT INFO" {
-			break
+			end = true
+			continue
 		}
 
 		if !strings.HasPrefix(line, "# ") {
@@ -118,14 +209,98 @@ func NewService(script string) (ret *Service, err error) {
 		}
 	}
 
+	copy(ret.Digest[:], h.Sum(nil))
+	ret.Reloadable = !ret.IsNonStop() && hasReload(lines)
+
+	if !ret.IsNonStop() && len(ret.Properties[Pidfile]) == 0 {
+		if pidfile := detectPidfile(lines); pidfile != "" {
+			d("Detected pidfile %s for %s", pidfile, script)
+			ret.Properties[Pidfile][pidfile] = true
+		}
+	}
+
 	return
 }
 
+// detectPidfile finds pidfile passed to "start-stop-daemon --start" in script.
+// Only simple variable assignments like PIDFILE=/run/$NAME.pid are expanded.
+func detectPidfile(lines []string) string {
+	vars := map[string]string{}
+	expand := func(str string) string {
+		return os.Expand(str, func(key string) string {
+			if v, ok := vars[key]; ok {
+				return v
+			}
+			return "$" + key
+		})
+	}
+
+	for idx := 0; idx < len(lines); idx++ {
+		line := strings.TrimSpace(lines[idx])
+		if m := assignRegexp.FindStringSubmatch(line); m != nil {
+			val := strings.Trim(m[2], `"'`)
+			if !strings.ContainsAny(val, "`(") {
+				vars[m[1]] = expand(val)
+			}
+			continue
+		}
+
+		if !strings.Contains(line, "start-stop-daemon") {
+			continue
+		}
+		for strings.HasSuffix(line, "\\") && idx+1 < len(lines) {
+			idx++
+			line = strings.TrimSuffix(line, "\\") + " " + strings.TrimSpace(lines[idx])
+		}
+
+		args := strings.Fields(line)
+		start := false
+		pidfile := ""
+		for i, arg := range args {
+			switch {
+			case arg == "--start" || arg == "-S":
+				start = true
+			case (arg == "--pidfile" || arg == "-p") && i+1 < len(args):
+				pidfile = args[i+1]
+			case strings.HasPrefix(arg, "--pidfile="):
+				pidfile = strings.TrimPrefix(arg, "--pidfile=")
+			}
+		}
+		if !start || pidfile == "" {
+			continue
+		}
+
+		pidfile = expand(strings.Trim(pidfile, `"'`))
+		if !strings.Contains(pidfile, "$") {
+			return pidfile
+		}
+	}
+	return ""
+}
+
+// hasReload detects if the script handles reload action in case statement,
+// like "reload)" or "reload|force-reload)"
+func hasReload(lines []string) bool {
+	for _, line := range lines {
+		if reloadRegexp.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+var reloadRegexp = regexp.MustCompile(`^\s*\(?["']?([\w-]+\|)*reload(\|[\w-]+)*["']?\)`)
+
+var assignRegexp = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)=(\S*)$`)
+
 func (s *Service) setProp(line string, prop Property) {
 	str := strings.TrimSpace(strings.TrimPrefix(line, string(prop)))
 	if str == "" {
 		return
 	}
+	if rawProps[prop] {
+		s.Raw[prop] = str
+	}
 	items := strings.Split(str, " ")
 	for _, item := range items {
 		if item == "" {
@@ -135,9 +310,19 @@ func (s *Service) setProp(line string, prop Property) {
 	}
 }
 
+// CanReload tests if the service can be reloaded without restarting
+func (s *Service) CanReload() bool {
+	return s.Reloadable || s.Value(ReloadSig) != ""
+}
+
 // IsNonStop tests if this service runs in non-stop subprocess (no forking in other words)
 func (s *Service) IsNonStop() bool {
-	for key, ok := range s.Properties[NonStop] {
+	return s.Bool(NonStop)
+}
+
+// Bool tests if a yes/no property is set to "yes" or "true"
+func (s *Service) Bool(prop Property) bool {
+	for key, ok := range s.Properties[prop] {
 		key := strings.ToLower(key)
 		if ok && (key == "true" || key == "yes") {
 			return true
@@ -146,10 +331,88 @@ func (s *Service) IsNonStop() bool {
 	return false
 }
 
-// CanStart detects if all dependencies of the Service is fulfilled
+// Value returns value of a single-valued property, or empty string if not set
+func (s *Service) Value(prop Property) string {
+	if rawProps[prop] {
+		return s.Raw[prop]
+	}
+	return strings.Join(s.Values(prop), " ")
+}
+
+// Values returns sorted items of a property
+func (s *Service) Values(prop Property) []string {
+	vals := make([]string, 0, len(s.Properties[prop]))
+	for val, ok := range s.Properties[prop] {
+		if ok {
+			vals = append(vals, val)
+		}
+	}
+	sort.Strings(vals)
+	return vals
+}
+
+// Int returns value of an integer property, or def if not set or malformed
+func (s *Service) Int(prop Property, def int) int {
+	ret, err := strconv.Atoi(s.Value(prop))
+	if err != nil {
+		return def
+	}
+	return ret
+}
+
+// Duration returns value of a time property, or def if not set or malformed.
+// Plain numbers are treated as seconds, like "1.5", or you can use "1500ms".
+func (s *Service) Duration(prop Property, def time.Duration) time.Duration {
+	if ret, err := parseDuration(s.Value(prop)); err == nil {
+		return ret
+	}
+	return def
+}
+
+// parseDuration parses plain numbers as seconds, or Go duration like "1500ms"
+func parseDuration(str string) (time.Duration, error) {
+	if sec, err := strconv.ParseFloat(str, 64); err == nil {
+		return time.Duration(sec * float64(time.Second)), nil
+	}
+	return time.ParseDuration(str)
+}
+
+// IsNotify tests if this service notifies its readiness through NOTIFY_SOCKET
+func (s *Service) IsNotify() bool {
+	return strings.ToLower(s.Value(Type)) == "notify"
+}
+
+// RestartPolicy returns one of RestartNo, RestartOnFailure or RestartAlways
+func (s *Service) RestartPolicy() string {
+	switch strings.ToLower(s.Value(Restart)) {
+	case RestartOnFailure:
+		return RestartOnFailure
+	case RestartAlways:
+		return RestartAlways
+	}
+	return RestartNo
+}
+
+// FailureAction returns one of FailIgnore, FailExit or FailStopDependents
+func (s *Service) FailureAction() string {
+	switch strings.ToLower(s.Value(FailAction)) {
+	case FailExit:
+		return FailExit
+	case FailStopDependents:
+		return FailStopDependents
+	}
+	return FailIgnore
+}
+
+// CanStart detects if all dependencies of the Service is fulfilled.
+// Dependencies not listed in state are treated as fulfilled.
 func (s *Service) CanStart(state map[string]State, prop Property) State {
 	for dep := range s.Properties[prop] {
-		switch state[dep] {
+		st, ok := state[dep]
+		if !ok {
+			continue
+		}
+		switch st {
 		case Failed, Error:
 			return Error
 		case Success:
@@ -160,10 +423,15 @@ func (s *Service) CanStart(state map[string]State, prop Property) State {
 	return Waiting
 }
 
-// CanStop detects if all dependencies of the Service is fulfilled
+// CanStop detects if all dependencies of the Service is fulfilled.
+// Dependencies not listed in state are treated as fulfilled.
 func (s *Service) CanStop(state map[string]State, prop Property) State {
 	for dep := range s.Properties[prop] {
-		switch state[dep] {
+		st, ok := state[dep]
+		if !ok {
+			continue
+		}
+		switch st {
 		case Failed, Error, Success:
 			continue
 		default:
@@ -174,8 +442,7 @@ func (s *Service) CanStop(state map[string]State, prop Property) State {
 }
 
 func (s *Service) removeNonexist(buf map[string][]*Service) {
-	props := Props[2:]
-	for _, prop := range props {
+	for _, prop := range DepProps {
 		for dep := range s.Properties[prop] {
 			if _, ok := buf[dep]; !ok {
 				delete(s.Properties[prop], dep)
@@ -89,3 +89,104 @@ func (m *ServiceManager) Normalize() {
 		srv.mergeDepend(buf, StopBefore, StopAfter)
 	}
 }
+
+// Providers finds services which provide dep
+func (m *ServiceManager) Providers(dep string) []*Service {
+	ret := []*Service{}
+	for _, srv := range m.Services {
+		if srv.Properties[Provides][dep] {
+			ret = append(ret, srv)
+		}
+	}
+	return ret
+}
+
+// Lookup finds services by the name they provide, or path or file name of the script
+func (m *ServiceManager) Lookup(name string) []*Service {
+	if ret := m.Providers(name); len(ret) > 0 {
+		return ret
+	}
+
+	ret := []*Service{}
+	for _, srv := range m.Services {
+		base := filepath.Base(srv.Script)
+		if base == name || strings.TrimSuffix(base, filepath.Ext(base)) == name {
+			ret = append(ret, srv)
+		}
+	}
+	return ret
+}
+
+// Dependencies finds all services which srv depends on directly or indirectly
+func (m *ServiceManager) Dependencies(srv *Service) []*Service {
+	found := map[*Service]bool{srv: true}
+	queue := []*Service{srv}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for dep := range cur.Properties[StartAfter] {
+			for _, other := range m.Providers(dep) {
+				if !found[other] {
+					found[other] = true
+					queue = append(queue, other)
+				}
+			}
+		}
+	}
+
+	delete(found, srv)
+	ret := make([]*Service, 0, len(found))
+	for s := range found {
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+// Dependents finds all services which depend on srv directly or indirectly
+func (m *ServiceManager) Dependents(srv *Service) []*Service {
+	found := map[*Service]bool{srv: true}
+	queue := []*Service{srv}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, other := range m.Services {
+			if found[other] {
+				continue
+			}
+			for dep := range cur.Properties[Provides] {
+				if other.Properties[StartAfter][dep] {
+					found[other] = true
+					queue = append(queue, other)
+					break
+				}
+			}
+		}
+	}
+
+	delete(found, srv)
+	ret := make([]*Service, 0, len(found))
+	for s := range found {
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+// Subset creates a ServiceManager contains only specified services.
+// Dependencies provided by other services are not listed in Deps.
+func (m *ServiceManager) Subset(srvs []*Service) *ServiceManager {
+	ret := &ServiceManager{
+		make(map[string]*Service),
+		nil,
+	}
+	deps := map[string]bool{}
+	for _, srv := range srvs {
+		ret.Services[srv.Script] = srv
+		for dep := range srv.Properties[Provides] {
+			deps[dep] = true
+		}
+	}
+	for dep := range deps {
+		ret.Deps = append(ret.Deps, dep)
+	}
+	return ret
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2016-2017 Ronmi Ren <ronmi@patrolavia.com>
+
+This file is part of YNIT.
+
+YNIT is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+YNIT is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with YNIT.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// signals forwarded to services when YNIT receives them, see X-Forward-Signals
+var serviceSignals = []os.Signal{
+	unix.SIGHUP,
+	unix.SIGUSR1,
+	unix.SIGUSR2,
+	unix.SIGWINCH,
+}
+
+// parseSignal parses signal like "HUP", "SIGHUP" or "1"
+func parseSignal(str string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(str); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+	str = strings.ToUpper(str)
+	if !strings.HasPrefix(str, "SIG") {
+		str = "SIG" + str
+	}
+	if sig := unix.SignalNum(str); sig != 0 {
+		return sig, nil
+	}
+	return 0, errors.New("unknown signal " + str)
+}
+
+// Kill sends sig to process group of the service
+func (s *Supervisor) Kill(srv *Service, sig syscall.Signal) error {
+	s.Lock()
+	pid := s.unit(srv).pid
+	s.Unlock()
+	if pid == 0 {
+		return errors.New("not running")
+	}
+
+	// daemons might be in same process group with us
+	if pgid, err := unix.Getpgid(pid); err == nil && pgid != unix.Getpgrp() {
+		pid = -pgid
+	}
+	return syscall.Kill(pid, sig)
+}
+
+// forwardSignals forwards signals received by YNIT to services. SIGHUP reloads
+// confdir first, and reloads services.
+func (c *Controller) forwardSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, serviceSignals...)
+	for sig := range sigs {
+		sig := sig.(syscall.Signal)
+		if sig == syscall.SIGHUP {
+			if resp := c.Execute(&ControlRequest{Command: "daemon-reload"}); !resp.OK {
+				log.Printf("Cannot reload services: %s", resp.Error)
+			}
+		}
+		c.forward(sig)
+	}
+}
+
+// forward sends sig to active services listing it in X-Forward-Signals, or
+// main service if none of them wants it. SIGHUP also reloads services which
+// can be reloaded.
+func (c *Controller) forward(sig syscall.Signal) {
+	c.Lock()
+	defer c.Unlock()
+	if c.sup.Halted() {
+		return
+	}
+
+	srvs := []*Service{}
+	mains := []*Service{}
+	for _, srv := range c.sup.Services().Services {
+		if srv.Bool(Main) {
+			mains = append(mains, srv)
+		}
+		if sig == syscall.SIGHUP && srv.CanReload() {
+			srvs = append(srvs, srv)
+			continue
+		}
+		for _, str := range srv.Values(ForwardSig) {
+			if s, err := parseSignal(str); err == nil && s == sig {
+				srvs = append(srvs, srv)
+				break
+			}
+		}
+	}
+	if len(srvs) == 0 {
+		srvs = mains
+	}
+
+	for _, srv := range srvs {
+		if !c.sup.Active(srv) {
+			continue
+		}
+		d("Forwarding %s to %s", sig, srv.Script)
+		var err error
+		if sig == syscall.SIGHUP {
+			err = c.sup.Reload(srv)
+		} else {
+			err = c.sup.Kill(srv, sig)
+		}
+		if err != nil {
+			log.Printf("Cannot forward %s to %s: %s", sig, srv.Script, err)
+		}
+	}
+}
@@ -19,35 +19,47 @@ along with YNIT.  If not, see <http://www.gnu.org/licenses/>.
 
 package main
 
-import "sync"
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// default delay between attempts to start a service
+const defaultRetryDelay = time.Second
 
 // ExecuteResult represents result of ynit script execution
 type ExecuteResult struct {
-	Service *Service
-	Result  State // must be one of Success of Failed
+	Service  *Service
+	Result   State // must be one of Success of Failed
+	Err      error // error of last attempt
+	Duration time.Duration
 }
 
 // Starter executes all ynit script
 type Starter struct {
 	prop          Property // parse deps using this property, must be one of StartAfter or StopAfter
-	pm            *ProcessManager
+	sup           *Supervisor
 	serviceStates map[*Service]State
 	depStates     map[string]State
 	result        chan *ExecuteResult
+	results       map[*Service]*ExecuteResult
 	*sync.Mutex
 	done chan bool
 }
 
 // NewStarter creates an executor
-func NewStarter(prop Property, pm *ProcessManager) *Starter {
+func NewStarter(prop Property, sup *Supervisor) *Starter {
 	return &Starter{
 		prop,
-		pm,
+		sup,
 		map[*Service]State{},
 		map[string]State{},
 		make(chan *ExecuteResult, 1),
+		map[*Service]*ExecuteResult{},
 		new(sync.Mutex),
-		make(chan bool),
+		make(chan bool, 1), // parse() might be called by Execute itself
 	}
 }
 
@@ -56,25 +68,80 @@ func (e *Starter) exec(srv *Service) {
 	ret := &ExecuteResult{
 		srv,
 		Success,
+		nil,
+		0,
 	}
 
-	if srv.IsNonStop() {
-		cmd, err := e.pm.Child(srv.Script)
-		srv.Process = cmd.Process
-		if err != nil {
-			ret.Result = Failed
+	begin := time.Now()
+	if err := e.waitFor(srv); err != nil {
+		ret.Result = Failed
+		ret.Err = err
+		ret.Duration = time.Since(begin)
+		d("Result of %s start: %s", srv.Script, ret.Result)
+		e.result <- ret
+		return
+	}
+
+	retries := srv.Int(Retries, 0)
+	for attempt := 0; ; attempt++ {
+		err := e.sup.Start(srv)
+		ret.Err = err
+		if err == nil {
+			break
 		}
-	} else {
-		if err := e.pm.Run(srv.Script, "start"); err != nil {
+		if retries > 0 {
+			log.Printf("Attempt %d/%d to start %s failed: %s", attempt+1, retries+1, srv.Script, err)
+		}
+		if attempt >= retries {
 			ret.Result = Failed
+			break
 		}
+
+		delay := srv.Duration(RetryDelay, defaultRetryDelay)
+		d("Retry starting %s in %s", srv.Script, delay)
+		time.Sleep(delay)
 	}
+	ret.Duration = time.Since(begin)
 	d("Result of %s start: %s", srv.Script, ret.Result)
 	e.result <- ret
 }
 
+// waitFor polls all targets in X-Wait-For at the same time, and returns
+// error of the first unavailable one
+func (e *Starter) waitFor(srv *Service) error {
+	targets := SplitProbes(srv.Value(WaitFor))
+	probes := make([]Probe, len(targets))
+	timeouts := make([]time.Duration, len(targets))
+	for idx, target := range targets {
+		p, timeout, err := ParseWaitTarget(target, waitTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid X-Wait-For target %s: %s", target, err)
+		}
+		probes[idx], timeouts[idx] = p, timeout
+	}
+
+	errs := make([]error, len(targets))
+	wg := &sync.WaitGroup{}
+	for idx, p := range probes {
+		wg.Add(1)
+		go func(idx int, p Probe) {
+			defer wg.Done()
+			d("Waiting for %s before starting %s", p, srv.Script)
+			errs[idx] = Poll(p, e.sup.pm, timeouts[idx], nil)
+		}(idx, p)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Execute ynit script
-func (e *Starter) Execute(m *ServiceManager) bool {
+func (e *Starter) Execute(m *ServiceManager) *Report {
 	// initialize states
 	e.Lock()
 	for _, srv := range m.Services {
@@ -90,25 +157,63 @@ func (e *Starter) Execute(m *ServiceManager) bool {
 	e.parse()
 	e.Unlock()
 
-	ret := <-e.done
-	return ret
+	<-e.done
+	return e.report()
 }
 
-func (e *Starter) trigger() {
-	for result := range e.result {
-		e.Lock()
-		e.serviceStates[result.Service] = result.Result
+// report collects final state of every service
+func (e *Starter) report() *Report {
+	e.Lock()
+	defer e.Unlock()
+	ret := &Report{make([]*ServiceReport, 0, len(e.serviceStates))}
+	for srv, state := range e.serviceStates {
+		r := newServiceReport(srv, state, e.results[srv])
+		if state == Error {
+			r.Cause = e.cause(srv)
+		}
+		ret.Services = append(ret.Services, r)
+	}
+	ret.sort()
+	return ret
+}
 
-		for dep := range result.Service.Properties[Provides] {
-			if result.Result == Success {
-				e.depStates[dep] = Success
+// cause finds the dependency chain from srv to the service which failed to start
+func (e *Starter) cause(srv *Service) []string {
+	ret := []string{srv.Script}
+	visited := map[*Service]bool{srv: true}
+	for cur := srv; e.serviceStates[cur] == Error; {
+		var next *Service
+		for dep := range cur.Properties[e.prop] {
+			st := e.depStates[dep]
+			if st != Failed && st != Error {
 				continue
 			}
-
-			if e.depStates[dep] != Success {
-				e.depStates[dep] = result.Result
+			for other, state := range e.serviceStates {
+				if !visited[other] && other.Properties[Provides][dep] && (state == Failed || state == Error) {
+					next = other
+					break
+				}
+			}
+			if next != nil {
+				ret = append(ret, dep, next.Script)
+				break
 			}
 		}
+		if next == nil {
+			break
+		}
+		visited[next] = true
+		cur = next
+	}
+	return ret
+}
+
+func (e *Starter) trigger() {
+	for result := range e.result {
+		e.Lock()
+		e.serviceStates[result.Service] = result.Result
+		e.results[result.Service] = result
+		e.update(result.Service, result.Result)
 
 		if len(e.result) == 0 {
 			e.parse()
@@ -117,29 +222,55 @@ func (e *Starter) trigger() {
 	}
 }
 
-func (e *Starter) parse() {
-	haveRunnable := false
-	haveError := false
+// update states of dependencies provided by srv
+func (e *Starter) update(srv *Service, state State) {
+	for dep := range srv.Properties[Provides] {
+		if state == Success {
+			e.depStates[dep] = Success
+			continue
+		}
 
-	for srv, state := range e.serviceStates {
-		// set flags
-		switch state {
-		case Pending, Waiting, Running:
-			haveRunnable = true
-		case Failed, Error:
-			haveError = true
+		if e.depStates[dep] != Success {
+			e.depStates[dep] = state
 		}
+	}
+}
+
+func (e *Starter) parse() {
+	// resolve pending services until nothing changes, as failures must be
+	// propagated to dependents of dependents
+	for changed := true; changed; {
+		changed = false
+		for srv, state := range e.serviceStates {
+			if state != Pending {
+				continue
+			}
 
-		if state == Pending {
 			state = srv.CanStart(e.depStates, e.prop)
+			if state == Pending {
+				continue
+			}
 			e.serviceStates[srv] = state
+			changed = true
+			if state == Error {
+				e.sup.Mark(srv, Error)
+				e.update(srv, Error)
+			}
 		}
+	}
 
-		if state == Waiting {
+	haveRunnable := false
+	haveError := false
+	for srv, state := range e.serviceStates {
+		switch state {
+		case Waiting:
 			e.serviceStates[srv] = Running
 			haveRunnable = true
 			go e.exec(srv)
-			continue
+		case Pending, Running:
+			haveRunnable = true
+		case Failed, Error:
+			haveError = haveError || !srv.Bool(Optional)
 		}
 	}
 
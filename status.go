@@ -0,0 +1,208 @@
+/*
+Copyright 2016-2017 Ronmi Ren <ronmi@patrolavia.com>
+
+This file is part of YNIT.
+
+YNIT is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+YNIT is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with YNIT.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// name of status file in rundir
+const statusFile = "status.json"
+
+// UnitStatus is runtime status of a service
+type UnitStatus struct {
+	Script   string     `json:"script"`
+	State    State      `json:"state"`
+	Optional bool       `json:"optional"`
+	Pid      int        `json:"pid,omitempty"`
+	Pgid     int        `json:"pgid,omitempty"`
+	Started  *time.Time `json:"started,omitempty"` // when it is started last time
+	Startup  float64    `json:"startup,omitempty"` // seconds taken to be ready last time
+	Restarts int        `json:"restarts"`
+	ExitCode *int       `json:"exit_code,omitempty"` // of last exited process, 128+signal if killed
+	Ready    bool       `json:"ready"`
+	Health   string     `json:"health,omitempty"`
+	Status   string     `json:"status,omitempty"` // STATUS= sent by the service
+	Provides []string   `json:"provides,omitempty"`
+	Depends  []string   `json:"depends,omitempty"` // what it requires to start
+}
+
+// Snapshot is runtime status of all services
+type Snapshot struct {
+	Time     time.Time     `json:"time"`
+	Services []*UnitStatus `json:"services"` // sorted by script path
+}
+
+// Status collects runtime status of all services
+func (s *Supervisor) Status() *Snapshot {
+	s.Lock()
+	defer s.Unlock()
+	ret := &Snapshot{time.Now(), make([]*UnitStatus, 0, len(s.services.Services))}
+	for _, srv := range s.services.Services {
+		u := s.unit(srv)
+		st := &UnitStatus{
+			Script:   srv.Script,
+			State:    u.state,
+			Optional: srv.Bool(Optional),
+			Pid:      u.pid,
+			Startup:  u.startup.Seconds(),
+			Restarts: u.restarts,
+			Ready:    u.state == Success && u.active(srv),
+			Health:   u.health,
+			Status:   u.status,
+			Depends:  srv.Values(StartAfter),
+		}
+		for _, name := range srv.Values(Provides) {
+			if name != srv.Script {
+				st.Provides = append(st.Provides, name)
+			}
+		}
+		if u.pid != 0 {
+			st.Pgid, _ = unix.Getpgid(u.pid)
+		}
+		if !u.started.IsZero() {
+			t := u.started
+			st.Started = &t
+		}
+		if u.exit != nil {
+			code := u.exit.Code()
+			st.ExitCode = &code
+		}
+		ret.Services = append(ret.Services, st)
+	}
+	sort.Slice(ret.Services, func(i, j int) bool {
+		return ret.Services[i].Script < ret.Services[j].Script
+	})
+	return ret
+}
+
+// changed tells status saver to write status file
+func (s *Supervisor) changed() {
+	select {
+	case s.dirty <- true:
+	default:
+		// already scheduled
+	}
+}
+
+// saveStatus writes status of all services to path whenever it is changed
+func (s *Supervisor) saveStatus(path string) {
+	for range s.dirty {
+		data, _ := json.MarshalIndent(s.Status(), "", "  ")
+		if err := writeAtomic(path, data); err != nil {
+			d("Cannot save status to %s: %s", path, err)
+		}
+	}
+}
+
+// writeAtomic writes data to a temporary file and renames it to path, so
+// readers never see partially written file
+func writeAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".status-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Problems lists non-optional services which are not working, and why
+func (s *Snapshot) Problems() []string {
+	ret := []string{}
+	for _, st := range s.Services {
+		if st.Optional {
+			continue
+		}
+		if problem := st.Problem(); problem != "" {
+			ret = append(ret, st.Script+": "+problem)
+		}
+	}
+	return ret
+}
+
+// Problem tells why the service is not working, empty if it is fine
+func (st *UnitStatus) Problem() string {
+	switch {
+	case st.Health == Unhealthy:
+		return "failing health checks"
+	case st.Ready:
+		return ""
+	case st.State == Success && st.Pid == 0 && st.ExitCode != nil && *st.ExitCode == 0:
+		// job finished successfully
+		return ""
+	case st.State == Running:
+		return "not ready"
+	case st.State == Waiting:
+		return "restarting"
+	}
+	return fmt.Sprintf("not running (%s)", st.State)
+}
+
+// Table formats the snapshot as human readable table
+func (s *Snapshot) Table() string {
+	buf := &bytes.Buffer{}
+	w := tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tSTATE\tREADY\tPID\tUPTIME\tRESTARTS\tLAST EXIT\tHEALTH\tSTATUS")
+	for _, st := range s.Services {
+		ready, pid, uptime, exit, health := "no", "-", "-", "-", "-"
+		if st.Ready {
+			ready = "yes"
+		}
+		if st.Pid != 0 {
+			pid = fmt.Sprint(st.Pid)
+		}
+		if st.Started != nil && st.Ready {
+			uptime = s.Time.Sub(*st.Started).Round(time.Second).String()
+		}
+		if st.ExitCode != nil {
+			exit = fmt.Sprint(*st.ExitCode)
+		}
+		if st.Health != "" {
+			health = st.Health
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			st.Script, st.State, ready, pid, uptime, st.Restarts, exit, health, st.Status)
+	}
+	w.Flush()
+	return buf.String()
+}
@@ -21,13 +21,13 @@ package main
 
 import (
 	"sync"
-	"syscall"
+	"time"
 )
 
 // Stopper executes all ynit script
 type Stopper struct {
 	prop          Property // parse deps using this property, must be one of StartAfter or StopAfter
-	pm            *ProcessManager
+	sup           *Supervisor
 	serviceStates map[*Service]State
 	depStates     map[string]State
 	result        chan *ExecuteResult
@@ -36,15 +36,15 @@ type Stopper struct {
 }
 
 // NewStopper creates an executor
-func NewStopper(prop Property, pm *ProcessManager) *Stopper {
+func NewStopper(prop Property, sup *Supervisor) *Stopper {
 	return &Stopper{
 		prop,
-		pm,
+		sup,
 		map[*Service]State{},
 		map[string]State{},
 		make(chan *ExecuteResult, 1),
 		new(sync.Mutex),
-		make(chan bool),
+		make(chan bool, 1), // parse() might be called by Execute itself
 	}
 }
 
@@ -53,20 +53,15 @@ func (e *Stopper) exec(srv *Service) {
 	ret := &ExecuteResult{
 		srv,
 		Success,
+		nil,
+		0,
 	}
 
-	if srv.IsNonStop() {
+	begin := time.Now()
+	if ret.Err = e.sup.Stop(srv); ret.Err != nil {
 		ret.Result = Failed
-		if srv.Process != nil {
-			if err := srv.Process.Signal(syscall.SIGINT); err == nil {
-				ret.Result = Success
-			}
-		}
-	} else {
-		if err := e.pm.Run(srv.Script, "stop"); err != nil {
-			ret.Result = Failed
-		}
 	}
+	ret.Duration = time.Since(begin)
 	d("Result of %s stop: %s", srv.Script, ret.Result)
 	e.result <- ret
 }
@@ -0,0 +1,716 @@
+/*
+Copyright 2016-2017 Ronmi Ren <ronmi@patrolavia.com>
+
+This file is part of YNIT.
+
+YNIT is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+YNIT is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with YNIT.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// default values of restart related properties
+const (
+	pidfileTimeout       = 5 * time.Second // how long to wait for a daemon to write its pidfile
+	defaultRestartSec    = 100 * time.Millisecond
+	maxRestartDelay      = time.Minute
+	defaultLimitBurst    = 5
+	defaultLimitInterval = 10 * time.Second
+	defaultReadyTimeout  = time.Minute
+)
+
+// unit holds runtime info of a supervised service
+type unit struct {
+	state    State
+	pid      int         // pid of non-stop process or daemon in pidfile, 0 if not watched
+	stopping bool        // being stopped by us, so its death is expected
+	exit     *ExitStatus // last exit status of the process
+	restarts int
+	backoff  uint          // consecutive failures, used to compute restart delay
+	history  []time.Time   // recent restarts, used for rate limiting
+	ready    chan bool     // closed when READY=1 is received
+	dead     chan bool     // closed when the process exits before Start returns
+	status   string        // STATUS= sent by the service
+	health   string        // result of health checks, empty if not checked yet
+	checks   chan bool     // closed to stop health checks
+	watchdog *time.Timer   // fired if WATCHDOG=1 is not received in time
+	started  time.Time     // when it is started last time
+	startup  time.Duration // how long it takes to be ready last time
+}
+
+// disarm stops health checks and watchdog of the unit, caller must hold the lock
+func (u *unit) disarm() {
+	if u.checks != nil {
+		close(u.checks)
+		u.checks = nil
+	}
+	if u.watchdog != nil {
+		u.watchdog.Stop()
+		u.watchdog = nil
+	}
+}
+
+// Supervisor starts and stops services, and watches their processes
+type Supervisor struct {
+	services *ServiceManager
+	pm       *ProcessManager
+	*sync.Mutex
+	units    map[string]*unit // by script, so it survives reloading
+	stopping bool
+	idle     bool // quit when all non-stop services are done
+	quit     chan int
+	rundir   string                   // where to create runtime files like notify sockets
+	sockets  map[string]*NotifySocket // by script
+	dirty    chan bool                // status is changed and should be saved
+}
+
+// NewSupervisor creates a Supervisor instance
+func NewSupervisor(services *ServiceManager, pm *ProcessManager, rundir string) *Supervisor {
+	ret := &Supervisor{
+		services,
+		pm,
+		new(sync.Mutex),
+		map[string]*unit{},
+		false,
+		false,
+		make(chan int, 1),
+		rundir,
+		map[string]*NotifySocket{},
+		make(chan bool, 1),
+	}
+	if rundir != "" {
+		go ret.saveStatus(filepath.Join(rundir, statusFile))
+	}
+	return ret
+}
+
+// Done returns a channel which receives exit code when ynit should quit
+func (s *Supervisor) Done() <-chan int {
+	return s.quit
+}
+
+// Shutdown asks ynit to stop all services and quit with code
+func (s *Supervisor) Shutdown(code int) {
+	select {
+	case s.quit <- code:
+	default:
+		// already shutting down
+	}
+}
+
+// Services returns services being managed, which might be replaced by Replace
+func (s *Supervisor) Services() *ServiceManager {
+	s.Lock()
+	defer s.Unlock()
+	return s.services
+}
+
+// Replace manages services loaded again from confdir. Services exist in both
+// keep their runtime info, as it is bound to the script. Removed services
+// should be stopped before.
+func (s *Supervisor) Replace(next *ServiceManager) {
+	s.Lock()
+	defer s.Unlock()
+	for path := range s.services.Services {
+		if _, ok := next.Services[path]; ok {
+			continue
+		}
+		if u, ok := s.units[path]; ok {
+			u.disarm()
+			delete(s.units, path)
+		}
+		if sock, ok := s.sockets[path]; ok {
+			_ = sock.Close()
+			delete(s.sockets, path)
+		}
+	}
+	s.services = next
+	s.changed()
+}
+
+// unit returns runtime info of srv, caller must hold the lock
+func (s *Supervisor) unit(srv *Service) *unit {
+	u, ok := s.units[srv.Script]
+	if !ok {
+		u = &unit{state: Pending}
+		s.units[srv.Script] = u
+	}
+	return u
+}
+
+// Mark sets state of a service which is not started by Supervisor
+func (s *Supervisor) Mark(srv *Service, state State) {
+	s.Lock()
+	defer s.Unlock()
+	s.unit(srv).state = state
+	s.changed()
+}
+
+// Start runs a service, and watches its process if possible.
+// For notify-type services, it also waits until the service is ready.
+func (s *Supervisor) Start(srv *Service) (err error) {
+	s.Lock()
+	u := s.unit(srv)
+	u.state = Running
+	u.pid = 0
+	u.stopping = false
+	u.status = ""
+	u.health = ""
+	u.disarm()
+	u.ready = make(chan bool)
+	u.dead = make(chan bool)
+	u.started = time.Now()
+	env := s.notifyEnv(srv)
+	s.changed()
+	s.Unlock()
+
+	if err = s.launch(srv, u, env); err == nil {
+		s.Lock()
+		s.armWatchdog(srv, u)
+		s.Unlock()
+	}
+	if err == nil && srv.IsNotify() {
+		err = s.waitReady(srv, u)
+	}
+	if err == nil && srv.Value(ReadyCheck) != "" {
+		err = s.probeReady(srv, u)
+	}
+	if err == nil && srv.Bool(StatusCheck) && !srv.IsNonStop() {
+		err = s.verify(srv)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	defer s.changed()
+	if err != nil {
+		u.state = Failed
+		u.disarm()
+		if u.pid != 0 {
+			// started but not ready, kill it so it can be started again
+			u.stopping = true
+			_ = syscall.Kill(u.pid, syscall.SIGKILL)
+		}
+		return
+	}
+
+	u.state = Success
+	u.startup = time.Since(u.started)
+	select {
+	case <-u.dead:
+		// exited while starting, handle it now
+		s.handleExit(srv, u, u.exit)
+	default:
+		s.checkHealth(srv, u)
+		s.checkStatus(srv, u)
+	}
+	return
+}
+
+// launch executes the service and watches its process if possible
+func (s *Supervisor) launch(srv *Service, u *unit, env []string) (err error) {
+	if srv.IsNonStop() {
+		var (
+			pid  int
+			exit <-chan *ExitStatus
+		)
+		if watchdogTimeout(srv) > 0 {
+			_, pid, exit, err = s.pm.ChildPid("WATCHDOG_PID", srv.Script, env...)
+		} else {
+			_, pid, exit, err = s.pm.Child(srv.Script, env...)
+		}
+		if err != nil {
+			return
+		}
+		s.supervise(srv, u, pid, exit)
+		return nil
+	}
+
+	if err = s.pm.Run(srv.Script, "start", env...); err != nil {
+		return
+	}
+	return s.track(srv, u)
+}
+
+// waitReady waits for READY=1 from a notify-type service
+func (s *Supervisor) waitReady(srv *Service, u *unit) error {
+	timeout := srv.Duration(ReadyTime, defaultReadyTimeout)
+	select {
+	case <-u.ready:
+		d("Service %s is ready", srv.Script)
+		return nil
+	case <-u.dead:
+		return fmt.Errorf("exited before ready: %s", u.exit)
+	case <-time.After(timeout):
+		return fmt.Errorf("not ready after %s", timeout)
+	}
+}
+
+// probeReady polls readiness check of the service until it succeeds
+func (s *Supervisor) probeReady(srv *Service, u *unit) error {
+	p, err := ParseProbe(srv.Value(ReadyCheck))
+	if err != nil {
+		return err
+	}
+
+	timeout := srv.Duration(ReadyTime, defaultReadyTimeout)
+	if err = Poll(p, s.pm, timeout, u.dead); err != nil {
+		select {
+		case <-u.dead:
+			return fmt.Errorf("exited before ready: %s", u.exit)
+		default:
+		}
+		return err
+	}
+	d("Service %s is ready: %s is available", srv.Script, p)
+	return nil
+}
+
+// notifyEnv creates notify socket for the service if needed, and returns
+// environment variables to pass it, caller must hold the lock
+func (s *Supervisor) notifyEnv(srv *Service) []string {
+	if s.rundir == "" {
+		return nil
+	}
+
+	sock, ok := s.sockets[srv.Script]
+	if !ok {
+		var err error
+		path := notifyPath(filepath.Join(s.rundir, "notify"), srv.Script)
+		sock, err = ListenNotify(path, func(msg map[string]string) {
+			s.notified(srv, msg)
+		})
+		if err != nil {
+			log.Printf("Cannot create notify socket for %s: %s", srv.Script, err)
+			return nil
+		}
+		s.sockets[srv.Script] = sock
+	}
+	ret := []string{"NOTIFY_SOCKET=" + sock.Path}
+	if t := watchdogTimeout(srv); t > 0 {
+		ret = append(ret, fmt.Sprintf("WATCHDOG_USEC=%d", t.Microseconds()))
+	}
+	return ret
+}
+
+// notified handles sd_notify messages from the service
+func (s *Supervisor) notified(srv *Service, msg map[string]string) {
+	s.Lock()
+	defer s.Unlock()
+	if cur, ok := s.services.Services[srv.Script]; ok {
+		// the socket is created before the script is reloaded
+		srv = cur
+	}
+	u := s.unit(srv)
+	d("Notification from %s: %v", srv.Script, msg)
+	defer s.changed()
+
+	if str, ok := msg["MAINPID"]; ok {
+		if pid, err := strconv.Atoi(str); err == nil && pid > 1 && pid != u.pid {
+			if exit, err := s.pm.Watch(pid, srv.Script); err == nil {
+				d("Main pid of %s is now %d", srv.Script, pid)
+				u.pid = pid
+				go func() {
+					s.exited(srv, u, <-exit)
+				}()
+			} else {
+				log.Printf("Cannot supervise %s: %s", srv.Script, err)
+			}
+		}
+	}
+	if str, ok := msg["STATUS"]; ok {
+		u.status = str
+	}
+	if msg["STOPPING"] == "1" {
+		// it is stopping by itself, so do not restart it
+		u.stopping = true
+	}
+	if msg["WATCHDOG"] == "1" && u.watchdog != nil {
+		u.watchdog.Reset(srv.Duration(WatchdogSec, 0))
+	}
+	if msg["WATCHDOG"] == "trigger" && u.watchdog != nil {
+		u.watchdog.Reset(0)
+	}
+	if msg["READY"] == "1" {
+		select {
+		case <-u.ready:
+		default:
+			close(u.ready)
+		}
+	}
+}
+
+// track watches the daemon recorded in pidfile of the service
+func (s *Supervisor) track(srv *Service, u *unit) error {
+	pidfile := srv.Value(Pidfile)
+	if pidfile == "" {
+		return nil
+	}
+
+	pid, err := readPidfile(pidfile, pidfileTimeout)
+	if err != nil {
+		log.Printf("Cannot supervise %s: %s", srv.Script, err)
+		return nil
+	}
+	exit, err := s.pm.Watch(pid, srv.Script)
+	if err != nil {
+		// it would look alive forever as we cannot reap it
+		return fmt.Errorf("cannot supervise pid %d from %s: %s", pid, pidfile, err)
+	}
+	d("Supervising %s with pid %d from %s", srv.Script, pid, pidfile)
+	s.supervise(srv, u, pid, exit)
+	return nil
+}
+
+// supervise waits for the process of a service in background
+func (s *Supervisor) supervise(srv *Service, u *unit, pid int, exit <-chan *ExitStatus) {
+	s.Lock()
+	u.pid = pid
+	s.changed()
+	s.Unlock()
+
+	go func() {
+		s.exited(srv, u, <-exit)
+	}()
+}
+
+// exited is called when the process of a service is dead
+func (s *Supervisor) exited(srv *Service, u *unit, st *ExitStatus) {
+	s.Lock()
+	defer s.Unlock()
+	if st.Pid != u.pid {
+		// not the main process anymore
+		return
+	}
+	u.pid = 0
+	u.exit = st
+	u.disarm()
+	s.changed()
+	if u.state == Running {
+		// still starting, let Start handle it
+		close(u.dead)
+		return
+	}
+	s.handleExit(srv, u, st)
+}
+
+// handleExit applies restart policy to dead service, caller must hold the lock
+func (s *Supervisor) handleExit(srv *Service, u *unit, st *ExitStatus) {
+	defer s.checkIdle()
+	if u.stopping || s.stopping {
+		d("Service %s stopped: %s", srv.Script, st)
+		if u.state == Success {
+			u.state = Stopped
+		}
+		return
+	}
+
+	u.state = Failed
+	if st.Success() {
+		u.state = Success
+	}
+	if srv.Bool(Main) {
+		log.Printf("Main service %s exited: %s, quitting", srv.Script, st)
+		s.Shutdown(st.Code())
+		return
+	}
+
+	log.Printf("Service %s exited: %s", srv.Script, st)
+	if !s.schedule(srv, u, st.Success(), st.Runtime) {
+		s.dead(srv, st.Code())
+	}
+}
+
+// dead is called when a service will not be restarted, caller must hold the lock
+func (s *Supervisor) dead(srv *Service, code int) {
+	if !srv.Bool(Critical) {
+		return
+	}
+
+	log.Printf("Critical service %s is dead, quitting", srv.Script)
+	if code == 0 {
+		code = 1
+	}
+	s.Shutdown(code)
+}
+
+// schedule restarts a dead service according to its restart policy, caller must hold the lock.
+// It returns false if the service is not going to be restarted.
+func (s *Supervisor) schedule(srv *Service, u *unit, success bool, runtime time.Duration) bool {
+	switch srv.RestartPolicy() {
+	case RestartAlways:
+	case RestartOnFailure:
+		if success {
+			return false
+		}
+	default:
+		return false
+	}
+
+	now := time.Now()
+	interval := srv.Duration(LimitIntvl, defaultLimitInterval)
+	recent := u.history[:0]
+	for _, t := range u.history {
+		if now.Sub(t) < interval {
+			recent = append(recent, t)
+		}
+	}
+	u.history = recent
+	if len(u.history) >= srv.Int(LimitBurst, defaultLimitBurst) {
+		log.Printf("Service %s restarted too often, giving up", srv.Script)
+		u.state = Failed
+		go s.fail(srv)
+		return false
+	}
+	u.history = append(u.history, now)
+
+	if runtime > interval {
+		// it has been running well for a while, so this is not a crash loop
+		u.backoff = 0
+	}
+	delay := srv.Duration(RestartSec, defaultRestartSec) << u.backoff
+	if delay > maxRestartDelay || delay <= 0 {
+		delay = maxRestartDelay
+	} else {
+		u.backoff++
+	}
+	u.restarts++
+	u.state = Waiting
+
+	log.Printf("Restarting %s in %s ...", srv.Script, delay)
+	time.AfterFunc(delay, func() { s.restart(srv) })
+	return true
+}
+
+// restart starts a dead service again unless it is being stopped
+func (s *Supervisor) restart(srv *Service) {
+	s.Lock()
+	// the script might be reloaded or removed after scheduled
+	cur, ok := s.services.Services[srv.Script]
+	if !ok || s.stopping {
+		s.Unlock()
+		return
+	}
+	srv = cur
+	u := s.unit(srv)
+	if u.stopping {
+		s.Unlock()
+		return
+	}
+	s.Unlock()
+
+	if err := s.Start(srv); err != nil {
+		log.Printf("Cannot restart %s: %s", srv.Script, err)
+		s.Lock()
+		if !s.schedule(srv, u, false, 0) {
+			s.dead(srv, 1)
+		}
+		s.changed()
+		s.Unlock()
+	}
+}
+
+// fail applies failure action of a service which cannot be restarted anymore
+func (s *Supervisor) fail(srv *Service) {
+	switch srv.FailureAction() {
+	case FailExit:
+		log.Printf("Service %s failed, quitting", srv.Script)
+		s.Shutdown(1)
+	case FailStopDependents:
+		services := s.Services()
+		deps := services.Dependents(srv)
+		log.Printf("Service %s failed, stopping %d dependent services", srv.Script, len(deps))
+		NewStopper(StopAfter, s).Execute(services.Subset(deps))
+	}
+}
+
+// QuitWhenIdle asks ynit to quit once processes of all non-stop services are done.
+// Exit code will be 1 if any of them failed.
+func (s *Supervisor) QuitWhenIdle() {
+	s.Lock()
+	defer s.Unlock()
+	s.idle = true
+	s.checkIdle()
+}
+
+// checkIdle quits if all non-stop services are done, caller must hold the lock
+func (s *Supervisor) checkIdle() {
+	if !s.idle || s.stopping {
+		return
+	}
+
+	code := 0
+	for _, srv := range s.services.Services {
+		if !srv.IsNonStop() {
+			continue
+		}
+		u := s.unit(srv)
+		switch {
+		case u.pid != 0, u.state == Pending, u.state == Waiting, u.state == Running:
+			return
+		case u.state == Failed, u.state == Error, u.exit != nil && !u.exit.Success():
+			code = 1
+		}
+	}
+
+	dp("All non-stop services are done, quitting")
+	s.Shutdown(code)
+}
+
+// Stop stops a service, its process will not be restarted
+func (s *Supervisor) Stop(srv *Service) error {
+	s.Lock()
+	u := s.unit(srv)
+	u.stopping = true
+	u.disarm()
+	if u.state == Waiting {
+		// pending restart is canceled
+		u.state = Stopped
+	}
+	s.changed()
+	s.Unlock()
+
+	if srv.IsNonStop() {
+		s.Lock()
+		pid := u.pid
+		s.Unlock()
+		if pid == 0 {
+			return errors.New("not running")
+		}
+		return syscall.Kill(pid, syscall.SIGINT)
+	}
+
+	if err := s.pm.Run(srv.Script, "stop"); err != nil {
+		return err
+	}
+	s.Lock()
+	u.state = Stopped
+	s.changed()
+	s.Unlock()
+	return nil
+}
+
+// Reload asks a service to reload its configuration, by sending SIGHUP to
+// non-stop job or executing reload action
+func (s *Supervisor) Reload(srv *Service) error {
+	sig := syscall.SIGHUP
+	if str := srv.Value(ReloadSig); str != "" {
+		var err error
+		if sig, err = parseSignal(str); err != nil {
+			return err
+		}
+	} else if !srv.IsNonStop() {
+		err := s.pm.Run(srv.Script, "reload")
+		var e *ExitError
+		if errors.As(err, &e) && e.Code() == lsbUnimplemented {
+			d("Script %s does not support reload, trying force-reload", srv.Script)
+			err = s.pm.Run(srv.Script, "force-reload")
+		}
+		return err
+	}
+
+	s.Lock()
+	pid := s.unit(srv).pid
+	s.Unlock()
+	if pid == 0 {
+		return errors.New("not running")
+	}
+	return syscall.Kill(pid, sig)
+}
+
+// Active tests if a service is started, or going to be restarted
+func (s *Supervisor) Active(srv *Service) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.unit(srv).active(srv)
+}
+
+// active tests if the service is started, or going to be restarted
+func (u *unit) active(srv *Service) bool {
+	switch u.state {
+	case Running, Waiting:
+		return true
+	case Success:
+		// scripts without pidfile are treated as running until stopped
+		return u.pid != 0 || !srv.IsNonStop() && srv.Value(Pidfile) == ""
+	}
+	return false
+}
+
+// Halt prevents any service to be restarted, must be called before stopping all services
+func (s *Supervisor) Halt() {
+	s.Lock()
+	defer s.Unlock()
+	s.stopping = true
+}
+
+// Halted tests if Halt is called, which means ynit is shutting down
+func (s *Supervisor) Halted() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.stopping
+}
+
+// Close releases resources like notify sockets, must be called after all services are stopped
+func (s *Supervisor) Close() {
+	if s.rundir != "" {
+		// status saver might not have a chance to save final status before we quit
+		data, _ := json.MarshalIndent(s.Status(), "", "  ")
+		_ = writeAtomic(filepath.Join(s.rundir, statusFile), data)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for script, sock := range s.sockets {
+		_ = sock.Close()
+		delete(s.sockets, script)
+	}
+}
+
+// readPidfile reads pid of a living process from pidfile, waits at most timeout for it
+func readPidfile(pidfile string, timeout time.Duration) (pid int, err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		var data []byte
+		if data, err = ioutil.ReadFile(pidfile); err == nil {
+			pid, err = strconv.Atoi(strings.TrimSpace(string(data)))
+			if err == nil && pid <= 1 {
+				err = fmt.Errorf("invalid pid %d in %s", pid, pidfile)
+			}
+			if err == nil {
+				if err = syscall.Kill(pid, 0); err == nil {
+					return
+				}
+				err = fmt.Errorf("process %d in %s is not running", pid, pidfile)
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return 0, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
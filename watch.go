@@ -0,0 +1,165 @@
+/*
+Copyright 2016-2017 Ronmi Ren <ronmi@patrolavia.com>
+
+This file is part of YNIT.
+
+YNIT is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+YNIT is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with YNIT.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// events which might change services
+const watchMask = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM |
+	unix.IN_MOVED_TO | unix.IN_ATTRIB | unix.IN_DELETE_SELF
+
+// ConfWatcher reloads services when files in confdir or its sub-directories
+// are changed, like SIGHUP does
+type ConfWatcher struct {
+	fd    int
+	file  *os.File      // wraps fd, so reading can be interrupted by closing it
+	delay time.Duration // wait until no more changes before reloading
+	ctrl  *Controller
+	dirs  map[int32]string // watch descriptor to directory
+	timer *time.Timer
+	*sync.Mutex
+}
+
+// WatchConfdir watches dir with inotify, and reloads services delay after the
+// last change
+func WatchConfdir(dir string, delay time.Duration, ctrl *Controller) (*ConfWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &ConfWatcher{
+		fd,
+		os.NewFile(uintptr(fd), "inotify"),
+		delay,
+		ctrl,
+		map[int32]string{},
+		nil,
+		new(sync.Mutex),
+	}
+	if err = ret.add(dir); err != nil {
+		ret.file.Close()
+		return nil, err
+	}
+	go ret.watch()
+	return ret, nil
+}
+
+// add watches dir and its sub-directories
+func (w *ConfWatcher) add(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, path, watchMask)
+		if err != nil {
+			return err
+		}
+		d("Watching %s", path)
+		w.dirs[int32(wd)] = path
+		return nil
+	})
+}
+
+func (w *ConfWatcher) watch() {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := string(buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)])
+			name = strings.TrimRight(name, "\x00")
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+			w.handle(ev.Wd, ev.Mask, name)
+		}
+	}
+}
+
+// handle processes an inotify event
+func (w *ConfWatcher) handle(wd int32, mask uint32, name string) {
+	w.Lock()
+	defer w.Unlock()
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		// some events are lost, reload anyway
+		log.Print("Too many changes in config dir, some events are lost")
+		w.schedule()
+		return
+	}
+	dir, ok := w.dirs[wd]
+	if !ok {
+		return
+	}
+	if mask&unix.IN_IGNORED != 0 {
+		// directory is removed
+		delete(w.dirs, wd)
+		return
+	}
+	if mask&unix.IN_ISDIR != 0 && mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+		if err := w.add(filepath.Join(dir, name)); err != nil {
+			log.Printf("Cannot watch %s: %s", filepath.Join(dir, name), err)
+		}
+	}
+	// temporary files of editors
+	if strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") {
+		return
+	}
+
+	d("Detected change of %s", filepath.Join(dir, name))
+	w.schedule()
+}
+
+// schedule reloads services after a while, so a series of changes triggers
+// only one reload. Caller must hold the lock.
+func (w *ConfWatcher) schedule() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.timer = time.AfterFunc(w.delay, w.reload)
+}
+
+func (w *ConfWatcher) reload() {
+	if resp := w.ctrl.Execute(&ControlRequest{Command: "daemon-reload"}); !resp.OK {
+		log.Printf("Cannot reload services: %s", resp.Error)
+	}
+}
+
+// Close stops watching
+func (w *ConfWatcher) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	return w.file.Close()
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2016-2017 Ronmi Ren <ronmi@patrolavia.com>
+
+This file is part of YNIT.
+
+YNIT is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+YNIT is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with YNIT.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"log"
+	"syscall"
+	"time"
+)
+
+// watchdogTimeout returns X-Watchdog-Sec of a notify-type service, 0 if disabled
+func watchdogTimeout(srv *Service) time.Duration {
+	if !srv.IsNotify() {
+		return 0
+	}
+	return srv.Duration(WatchdogSec, 0)
+}
+
+// armWatchdog starts watchdog timer of a launched service, it is reset by every
+// WATCHDOG=1 notification, caller must hold the lock
+func (s *Supervisor) armWatchdog(srv *Service, u *unit) {
+	t := watchdogTimeout(srv)
+	if t <= 0 || s.sockets[srv.Script] == nil {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(t, func() {
+		s.Lock()
+		defer s.Unlock()
+		if u.watchdog == timer {
+			s.starved(srv, u)
+		}
+	})
+	u.watchdog = timer
+}
+
+// starved aborts a service which does not send keep-alive in time, so it can be
+// handled by restart policy, caller must hold the lock
+func (s *Supervisor) starved(srv *Service, u *unit) {
+	u.watchdog = nil
+	pid := u.pid
+	if pid == 0 {
+		log.Printf("Watchdog timeout of %s, but its process is not supervised", srv.Script)
+		return
+	}
+
+	log.Printf("Watchdog timeout of %s, aborting pid %d", srv.Script, pid)
+	_ = syscall.Kill(pid, syscall.SIGABRT)
+	time.AfterFunc(stopTimeout, func() {
+		s.Lock()
+		defer s.Unlock()
+		if u.pid == pid {
+			log.Printf("Service %s does not abort in %s, killing pid %d", srv.Script, stopTimeout, pid)
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+		}
+	})
+}